@@ -1,3 +1,9 @@
 module github.com/joeycumines/har-extractor
 
 go 1.20
+
+require (
+	github.com/andybalholm/brotli v1.1.1
+	golang.org/x/net v0.17.0
+	golang.org/x/text v0.14.0
+)
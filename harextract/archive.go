@@ -0,0 +1,123 @@
+package harextract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Archive receives extracted files in place of the file system, when set as
+// Options.Archive. It must be safe for concurrent use.
+type Archive interface {
+	// WriteFile adds a file with the slash separated name, consisting of the
+	// size bytes read from r. The modification time is modTime, or the
+	// current time if it is zero.
+	WriteFile(name string, r io.Reader, size int64, modTime time.Time) error
+}
+
+// ZipArchive is an Archive writing a zip file.
+type ZipArchive struct {
+	mu sync.Mutex
+	w  *zip.Writer
+}
+
+// NewZipArchive returns a ZipArchive writing to w. It must be closed to
+// complete the zip file.
+func NewZipArchive(w io.Writer) *ZipArchive {
+	return &ZipArchive{w: zip.NewWriter(w)}
+}
+
+func (a *ZipArchive) WriteFile(name string, r io.Reader, size int64, modTime time.Time) error {
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	// each file must be completely written before the next is created
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	w, err := a.w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Close writes the zip central directory, without closing the underlying
+// writer.
+func (a *ZipArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
+
+// TarArchive is an Archive writing a tar stream.
+type TarArchive struct {
+	mu   sync.Mutex
+	w    *tar.Writer
+	perm os.FileMode
+}
+
+// NewTarArchive returns a TarArchive writing to w, with files having the
+// permissions perm. It must be closed to complete the tar stream.
+func NewTarArchive(w io.Writer, perm os.FileMode) *TarArchive {
+	return &TarArchive{w: tar.NewWriter(w), perm: perm}
+}
+
+func (a *TarArchive) WriteFile(name string, r io.Reader, size int64, modTime time.Time) error {
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(a.perm.Perm()),
+		Size:     size,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(a.w, r)
+	if n < size {
+		// the header can't be amended, so the file is padded to keep the
+		// rest of the stream valid
+		if _, padErr := io.CopyN(a.w, zeros{}, size-n); err == nil {
+			err = padErr
+		}
+		if err == nil {
+			err = fmt.Errorf("%s: wrote %d of %d bytes", name, n, size)
+		}
+	}
+	return err
+}
+
+// Close writes the tar footer, without closing the underlying writer.
+func (a *TarArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
+
+// zeros is an io.Reader of endless zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
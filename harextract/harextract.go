@@ -0,0 +1,2345 @@
+// Package harextract implements a streaming HAR file parser, which extracts
+// response content to disk, preserving the directory structure of the URLs.
+// Gzip compressed HAR files are detected and decompressed automatically.
+package harextract
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Content struct {
+	Size        int    `json:"size"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text"`
+	Compression int    `json:"compression"`
+	Encoding    string `json:"encoding"`
+}
+
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Response struct {
+	Status      int      `json:"status"`
+	Headers     []Header `json:"headers"`
+	Content     Content  `json:"content"`
+	RedirectURL string   `json:"redirectURL"`
+}
+
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type Request struct {
+	Method   string    `json:"method"`
+	URL      string    `json:"url"`
+	PostData *PostData `json:"postData"`
+}
+
+type Entry struct {
+	StartedDateTime string   `json:"startedDateTime"`
+	Request         Request  `json:"request"`
+	Response        Response `json:"response"`
+	ResourceType    string   `json:"_resourceType"`
+	PageRef         string   `json:"pageref"`
+	// WebSocketMessages are the frames of a WebSocket connection, as recorded
+	// by Chrome.
+	WebSocketMessages []WSMessage `json:"_webSocketMessages"`
+}
+
+// WSMessage is a WebSocket frame, sent or received at Time (in seconds since
+// the epoch). Data is text for text frames (Opcode 1), and base64 encoded
+// otherwise.
+type WSMessage struct {
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+// lazyEntry decodes an Entry, except for the response content text, which is
+// kept raw so that it's only decoded for entries that pass the filters.
+type lazyEntry struct {
+	Entry
+	Response struct {
+		Response
+		Content struct {
+			Content
+			Text json.RawMessage `json:"text"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+// split returns the decoded entry, with an empty response text, and the raw
+// text, which is nil if missing.
+func (l *lazyEntry) split() (Entry, json.RawMessage) {
+	entry := l.Entry
+	entry.Response = l.Response.Response
+	entry.Response.Content = l.Response.Content.Content
+	return entry, l.Response.Content.Text
+}
+
+// rawEntry is an Entry with its response text yet to be decoded.
+type rawEntry struct {
+	entry Entry
+	text  json.RawMessage
+	// page is the page directory of the entry, with ByPage.
+	page string
+	// index is the position of the entry within the entries array.
+	index int
+}
+
+// Options configures how HAR entries are extracted. The zero value writes
+// every entry to the current directory.
+type Options struct {
+	// RootDir is the output directory, which defaults to the current
+	// directory.
+	RootDir           string
+	RemoveQueryString bool
+	// QueryHash appends a short hash of the query, if any, to output file
+	// names (before the extension), e.g. "search-a1b2c3d4".
+	QueryHash bool
+	// QueryAsDir writes entries with a query to an index file within a
+	// directory named for the query, e.g. "file/a=1_b=2/index.html", so that
+	// distinct queries don't collide.
+	QueryAsDir bool
+	// StripPathPrefix is removed from the start of URL paths, e.g.
+	// "/static/assets" writes "/static/assets/app.js" as "/app.js". It must
+	// match whole path segments.
+	StripPathPrefix string
+	// SkipUnprefixed skips entries whose URL path doesn't begin with the
+	// StripPathPrefix.
+	SkipUnprefixed bool
+	// DryRun disables writing to disk.
+	DryRun bool
+	// DirsOnly creates the output directories of a dry run, without writing
+	// any files, for which it implies DryRun. It has no effect with Archive.
+	DirsOnly bool
+	// Verbose logs each file written, and the reason entries are skipped.
+	Verbose bool
+
+	// Entries are skipped unless they match all of the following filters,
+	// where empty filters match everything.
+
+	HostAllowlist map[string]bool
+	HostDenylist  map[string]bool
+	// MimeTypes contains lowercase media types, or "type/*" wildcards.
+	MimeTypes     map[string]bool
+	Statuses      []StatusRange
+	SkipRedirects bool
+	// Methods contains uppercase request methods.
+	Methods map[string]bool
+	// ResourceTypes contains lowercase Chrome _resourceType values.
+	ResourceTypes map[string]bool
+	URLInclude    *regexp.Regexp
+	URLExclude    *regexp.Regexp
+	// QueryParams must all be present in the request URL.
+	QueryParams []QueryParam
+	// IncludeExtensions and ExcludeExtensions contain lowercase file
+	// extensions, with the leading dot, matched against the output path.
+	IncludeExtensions map[string]bool
+	ExcludeExtensions map[string]bool
+	// After and Before bound the startedDateTime of entries, if non-zero.
+	// Entries without a valid startedDateTime are kept.
+	After  time.Time
+	Before time.Time
+	// MaxSize is the largest response body written, if non-zero.
+	MaxSize int64
+	// MinSize is the smallest (decoded) response body written.
+	MinSize   int64
+	SkipEmpty bool
+
+	DecodeContentEncoding bool
+	NoClobber             bool
+	// Concurrency is the number of entries processed concurrently, which
+	// defaults to 1.
+	Concurrency int
+	// BufferSize is the size in bytes of the buffer HARs are read through,
+	// which defaults to 4096. Larger buffers can improve throughput for
+	// large HARs.
+	BufferSize int
+	// Creator, if set, skips the HAR unless the name of its log.creator (the
+	// tool that produced it) contains Creator, ignoring case, returning
+	// ErrCreatorMismatch.
+	Creator string
+	// Strict requires the HAR to consist of a log object with an entries
+	// array, of entries each having a request URL, rather than scanning for
+	// an entries array anywhere at the top two levels. Entries with an
+	// unsupported content encoding are skipped, rather than written as text.
+	Strict bool
+	// SkipErrors logs and skips entries that fail to process, rather than
+	// abandoning the HAR.
+	SkipErrors bool
+	// Progress periodically logs the number of entries processed.
+	Progress bool
+	// Flatten writes all files directly to RootDir, ignoring NameTemplate.
+	Flatten      bool
+	DedupeSuffix bool
+	// IndexName is the file name used for URLs with a directory style path,
+	// which defaults to "index.html".
+	IndexName string
+	// NameTemplate produces the output path of each entry from NameFields,
+	// and defaults to DefaultNameTemplate.
+	NameTemplate   *template.Template
+	LowercaseHosts bool
+	KeepPort       bool
+	// RegisteredDomain names host directories for the registered domain of
+	// the host (one label more than its public suffix), e.g. "example.com"
+	// for "a.example.com", so that subdomains are grouped together.
+	RegisteredDomain bool
+	// SubdomainDirs nests each host directory within that of its registered
+	// domain, e.g. "example.com/a.example.com", with RegisteredDomain.
+	SubdomainDirs bool
+	// UnicodeHosts names host directories for the Unicode form of
+	// internationalized domain names, e.g. "münchen.de" rather than
+	// "xn--mnchen-3ya.de".
+	UnicodeHosts bool
+	// SchemePrefix nests each host directory under a directory named for the
+	// URL scheme, e.g. "https".
+	SchemePrefix bool
+	// ByPage nests output under a directory named for the title (or id) of
+	// the page each entry belongs to, or "_nopage" for entries without one.
+	ByPage bool
+	// StatusDir, if set to StatusDirClass or StatusDirExact, nests output
+	// under a directory for the response status within the host directory.
+	StatusDir    string
+	DecodePath   bool
+	AddExtension bool
+	// OnCollision is how entries for different URLs with the same output path
+	// are handled: CollisionWarn (the default) overwrites the earlier file
+	// with a warning, CollisionError fails the entry, CollisionSuffix inserts
+	// a numeric suffix before the extension, and CollisionOverwrite
+	// overwrites it silently. It doesn't apply with Flatten or DedupeSuffix,
+	// which make paths unique.
+	OnCollision string
+	// ErrorsDir, if set, is a relative directory that entries with an error
+	// status (400 or above) are written under, rather than alongside other
+	// entries.
+	ErrorsDir string
+	// PathPrefix, if set, is a relative directory that all entries are
+	// written under, which unlike RootDir is part of their output paths.
+	PathPrefix string
+	// Slugify makes output path elements ASCII, removing accents,
+	// transliterating Cyrillic, and replacing other characters with "_".
+	Slugify bool
+	// MaxFileNameLen is the maximum length in bytes of each element of an
+	// output path, if non-zero. Longer elements are truncated, with a short
+	// hash of the original appended.
+	MaxFileNameLen int
+	// LinkRedirects replaces the file written for each redirect response with
+	// a symlink to the file written for the URL it redirects to, if any, once
+	// every HAR has been processed, by Extract or Extractor.LinkRedirects. It
+	// has no effect with an Archive.
+	LinkRedirects bool
+	// SkipDataURIs skips entries for data URIs, which are otherwise written
+	// to a "_data" directory, named by a hash of the URI.
+	SkipDataURIs bool
+	// VerifySize logs a warning for bodies whose length differs from the
+	// recorded content size by more than sizeTolerance, which may indicate a
+	// truncated or corrupt capture.
+	VerifySize bool
+	// Limit is the maximum number of entries written, if non-zero.
+	Limit           int
+	ExtractRequests bool
+	SaveHeaders     bool
+	// ExtractWebSockets also writes WebSocket frames, to numbered files in a
+	// sibling directory with a .ws suffix.
+	ExtractWebSockets bool
+	PreserveTime      bool
+	Dedupe            bool
+	DedupeSymlink     bool
+	// DirMode and FileMode are the permissions of created directories and
+	// files (before the umask), which default to 0755 and 0644.
+	DirMode  os.FileMode
+	FileMode os.FileMode
+	// Atomic writes each file via a temporary file, renamed into place once
+	// complete. The FileMode is then applied regardless of the umask.
+	Atomic bool
+	// WriteRetries is the number of times a file write failing with a
+	// transient error (such as EAGAIN or EBUSY, as network file systems may
+	// return) is retried, with exponential backoff. It has no effect with
+	// Archive.
+	WriteRetries int
+	// Archive, if non-nil, receives each file in place of RootDir, named by
+	// its slash separated output path. NoClobber and DedupeSymlink have no
+	// effect, so duplicates are skipped, as are entries for output paths
+	// already written, which can't be replaced.
+	Archive Archive
+
+	// OnEntry, if non-nil, is called with each entry as it is decoded, and
+	// may modify it. Entries are skipped if it returns true, and extraction is
+	// abandoned if it returns an error.
+	OnEntry func(entry *Entry) (skip bool, err error)
+	// OnWritten, if non-nil, is called with the record of each entry written
+	// (or that would have been, in dry run mode). Neither hook is called
+	// concurrently, even by an Extractor processing several HARs at once.
+	OnWritten func(written ManifestEntry)
+
+	// Logger receives log messages, which are discarded if it is nil.
+	Logger Logger
+
+	// Manifest enables collecting ManifestEntry values in Stats.Manifest.
+	Manifest bool
+}
+
+func (o *Options) dirMode() os.FileMode {
+	if o.DirMode == 0 {
+		return 0755
+	}
+	return o.DirMode
+}
+
+func (o *Options) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return 0644
+	}
+	return o.FileMode
+}
+
+func (o *Options) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return 4096
+	}
+	return o.BufferSize
+}
+
+// Values of Options.OnCollision.
+const (
+	CollisionWarn      = "warn"
+	CollisionError     = "error"
+	CollisionSuffix    = "suffix"
+	CollisionOverwrite = "overwrite"
+)
+
+// Values of Options.StatusDir.
+const (
+	StatusDirClass = "class" // e.g. "4xx"
+	StatusDirExact = "exact" // e.g. "404"
+)
+
+// Stats summarises the processing of one or more HAR files.
+type Stats struct {
+	Entries int
+	Written int
+	Skipped int
+	// SkipReasons is the number of entries skipped for each reason.
+	SkipReasons map[SkipReason]int
+	// Failed is the number of entries that failed with Options.SkipErrors.
+	Failed int
+	// Bytes is the total size of the bodies written.
+	Bytes int64
+	// Hosts is the number of entries written per host.
+	Hosts    map[string]int
+	Manifest []ManifestEntry
+}
+
+// SkipReason is why an entry was skipped, as counted by Stats.SkipReasons.
+type SkipReason string
+
+// Reasons entries are skipped, by the filter or option responsible.
+const (
+	SkipReasonHost         SkipReason = "host"          // HostAllowlist or HostDenylist
+	SkipReasonDataURI      SkipReason = "data-uri"      // SkipDataURIs
+	SkipReasonMimeType     SkipReason = "mime-type"     // MimeTypes
+	SkipReasonStatus       SkipReason = "status"        // Statuses
+	SkipReasonRedirect     SkipReason = "redirect"      // SkipRedirects
+	SkipReasonMethod       SkipReason = "method"        // Methods
+	SkipReasonResourceType SkipReason = "resource-type" // ResourceTypes
+	SkipReasonURL          SkipReason = "url"           // URLInclude or URLExclude
+	SkipReasonQuery        SkipReason = "query"         // QueryParams
+	SkipReasonTime         SkipReason = "time"          // After or Before
+	SkipReasonEncoding     SkipReason = "encoding"      // an unsupported content encoding, with Strict
+	SkipReasonEmpty        SkipReason = "empty"         // SkipEmpty
+	SkipReasonTooLarge     SkipReason = "too-large"     // MaxSize
+	SkipReasonTooSmall     SkipReason = "too-small"     // MinSize
+	SkipReasonPathPrefix   SkipReason = "path-prefix"   // SkipUnprefixed
+	SkipReasonExtension    SkipReason = "extension"     // IncludeExtensions or ExcludeExtensions
+	SkipReasonDuplicate    SkipReason = "duplicate"     // Dedupe or DedupeSuffix
+	SkipReasonExists       SkipReason = "exists"        // NoClobber, or already written to Archive
+	SkipReasonLimit        SkipReason = "limit"         // Limit
+	SkipReasonHook         SkipReason = "hook"          // OnEntry
+)
+
+func (s Stats) String() string {
+	str := fmt.Sprintf("%d entries processed, %d written, %d skipped", s.Entries, s.Written, s.Skipped)
+	if s.Failed > 0 {
+		str += fmt.Sprintf(", %d failed", s.Failed)
+	}
+	return str + ", " + FormatBytes(s.Bytes)
+}
+
+// record updates s with an entry that was processed successfully, where
+// written is nil if the entry was skipped, for the given reason.
+func (s *Stats) record(written *ManifestEntry, reason SkipReason, opts *Options) {
+	s.Entries++
+	if written == nil {
+		s.Skipped++
+		if s.SkipReasons == nil {
+			s.SkipReasons = make(map[SkipReason]int)
+		}
+		s.SkipReasons[reason]++
+		return
+	}
+	s.Written++
+	s.Bytes += int64(written.Bytes)
+	if s.Hosts == nil {
+		s.Hosts = make(map[string]int)
+	}
+	s.Hosts[written.Host]++
+	if opts.Manifest {
+		s.Manifest = append(s.Manifest, *written)
+	}
+}
+
+// Add accumulates other into s.
+func (s *Stats) Add(other Stats) {
+	s.Entries += other.Entries
+	s.Written += other.Written
+	s.Skipped += other.Skipped
+	s.Failed += other.Failed
+	s.Bytes += other.Bytes
+	for host, count := range other.Hosts {
+		if s.Hosts == nil {
+			s.Hosts = make(map[string]int)
+		}
+		s.Hosts[host] += count
+	}
+	for reason, count := range other.SkipReasons {
+		if s.SkipReasons == nil {
+			s.SkipReasons = make(map[SkipReason]int)
+		}
+		s.SkipReasons[reason] += count
+	}
+	s.Manifest = append(s.Manifest, other.Manifest...)
+}
+
+// ManifestEntry records a response that was extracted to disk.
+type ManifestEntry struct {
+	// Index is the position of the entry within the entries of its HAR.
+	Index      int    `json:"index"`
+	URL        string `json:"url"`
+	Method     string `json:"method"`
+	Host       string `json:"host"`
+	Status     int    `json:"status"`
+	MimeType   string `json:"mimeType"`
+	OutputPath string `json:"outputPath"`
+	Bytes      int    `json:"bytes"`
+}
+
+// QueryParam is a request URL query parameter, which must equal Value if
+// HasValue is set.
+type QueryParam struct {
+	Name     string
+	Value    string
+	HasValue bool
+}
+
+// StatusRange is an inclusive range of HTTP response status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Extractor extracts HAR files, sharing state such as the output paths
+// claimed and the limit on entries written, between calls to Extract.
+type Extractor struct {
+	opts Options
+	st   state
+}
+
+// New returns an Extractor configured by opts.
+func New(opts Options) *Extractor {
+	if opts.DirsOnly {
+		opts.DryRun = true
+	}
+	return &Extractor{opts: opts}
+}
+
+// Extract extracts the HAR read from r, which may be gzip compressed, as
+// configured by opts.
+func Extract(ctx context.Context, r io.Reader, opts Options) (Stats, error) {
+	x := New(opts)
+	res, err := x.Extract(ctx, r)
+	// including those written before any error
+	x.LinkRedirects()
+	return res, err
+}
+
+// Extract extracts the HAR read from r, which may be gzip compressed. If r
+// is a file, or has a Size method (like bytes.Reader), its size is used to
+// estimate the remaining time for Options.Progress. If ctx is canceled, no
+// further entries are decoded, and ctx.Err() is returned once those already
+// started have been processed. The Stats are valid even if an error is
+// returned.
+func (x *Extractor) Extract(ctx context.Context, r io.Reader) (Stats, error) {
+	var size int64
+	switch r := r.(type) {
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+	case interface{ Size() int64 }:
+		size = r.Size()
+	}
+	return readHar(ctx, r, size, &x.opts, &x.st)
+}
+
+// LinkRedirects links the redirects written since the last call, with
+// Options.LinkRedirects. It should be called once every HAR has been
+// extracted, as redirect targets may be written by a later HAR.
+func (x *Extractor) LinkRedirects() {
+	linkRedirects(&x.opts, &x.st)
+}
+
+// SavedBytes returns the total size of the duplicate bodies skipped or
+// symlinked with Options.Dedupe.
+func (x *Extractor) SavedBytes() int64 {
+	x.st.mu.Lock()
+	defer x.st.mu.Unlock()
+	return x.st.savedBytes
+}
+
+// state is shared between all entries processed by an Extractor, across HAR
+// files.
+type state struct {
+	mu sync.Mutex
+	// hooks serialises calls to Options.OnEntry and Options.OnWritten,
+	// including those for HARs processed concurrently
+	hooks sync.Mutex
+	// paths maps each claimed output path to a hash of its content, which is
+	// only tracked for paths claimed via claimContent
+	paths map[string]string
+	// hashes maps the hash of each distinct body recorded via recordHash to
+	// the path it was first written to
+	hashes map[[sha256.Size]byte]string
+	// savedBytes is the total size of the duplicate bodies seen by lookupHash
+	savedBytes int64
+	// writes is the number of writes reserved via claimWrite
+	writes int
+	// urls maps each output path claimed via claimURL to the URL of the
+	// entry it was claimed for
+	urls map[string]string
+	// written maps the URL of each entry written to its output path, and
+	// redirects are those yet to be linked, with LinkRedirects
+	written   map[string]string
+	redirects []redirect
+	// archived holds the output paths claimed via claimArchived
+	archived map[string]bool
+	// pathLocks holds the locks of the output paths being written, via
+	// lockPath
+	pathLocks map[string]*pathLock
+}
+
+// pathLock serialises writes to an output path, and is shared by the refs
+// entries writing it.
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockPath locks path against writes for other entries, which may share it,
+// returning the function that unlocks it.
+func (st *state) lockPath(path string) func() {
+	st.mu.Lock()
+	if st.pathLocks == nil {
+		st.pathLocks = make(map[string]*pathLock)
+	}
+	l := st.pathLocks[path]
+	if l == nil {
+		l = &pathLock{}
+		st.pathLocks[path] = l
+	}
+	l.refs++
+	st.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(st.pathLocks, path)
+		}
+	}
+}
+
+// redirect is the output path of a redirect response, and the URL it
+// redirects to.
+type redirect struct {
+	path   string
+	target string
+}
+
+// recordWrite records that the entry for u was written to path, which is to
+// be linked to the output path of target, if non-nil, once known.
+func (st *state) recordWrite(u *url.URL, path string, target *url.URL) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.written == nil {
+		st.written = make(map[string]string)
+	}
+	st.written[redirectKey(u)] = path
+	if target != nil {
+		st.redirects = append(st.redirects, redirect{path, redirectKey(target)})
+	}
+}
+
+// redirectKey returns u normalised so that a redirect matches the entry it
+// targets however each spells the URL: without any fragment, which isn't sent
+// to the server, a default port, or any optional percent-encoding, and with a
+// lower case scheme and host.
+func redirectKey(u *url.URL) string {
+	key := *u
+	key.Scheme = strings.ToLower(key.Scheme)
+	key.Host = strings.ToLower(key.Host)
+	if port := key.Port(); (key.Scheme == "http" && port == "80") || (key.Scheme == "https" && port == "443") {
+		key.Host = strings.TrimSuffix(key.Host, ":"+port)
+	}
+	key.RawPath = ""
+	key.Fragment, key.RawFragment = "", ""
+	return key.String()
+}
+
+// linkRedirects replaces the file written for each recorded redirect with a
+// symlink to the output path of its target, if that was also written. Where
+// symlinks can't be created, the redirect bodies are kept.
+func linkRedirects(opts *Options, st *state) {
+	st.mu.Lock()
+	redirects := st.redirects
+	st.redirects = nil
+	targets := make([]string, len(redirects))
+	for i, r := range redirects {
+		targets[i] = st.written[r.target]
+	}
+	st.mu.Unlock()
+
+	for i, r := range redirects {
+		if targets[i] == "" || targets[i] == r.path {
+			continue
+		}
+		linkTarget, err := filepath.Rel(filepath.Dir(r.path), targets[i])
+		if err != nil {
+			continue
+		}
+		filePath := filepath.Join(opts.RootDir, r.path)
+		if err := replaceWithSymlink(linkTarget, filePath); err != nil {
+			if opts.Verbose {
+				opts.log(LevelInfo, "Keeping redirect body", field("path", filePath), field("error", err))
+			}
+			continue
+		}
+		if opts.Verbose {
+			opts.log(LevelInfo, "Linking", field("path", filePath), field("target", linkTarget))
+		}
+	}
+}
+
+// claimWrite reserves one of the limit writes allowed across the run,
+// returning false if none remain. A limit of zero is unlimited.
+func (st *state) claimWrite(limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.writes >= limit {
+		return false
+	}
+	st.writes++
+	return true
+}
+
+// limitReached reports whether every one of the limit writes allowed across
+// the run has been reserved via claimWrite.
+func (st *state) limitReached(limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.writes >= limit
+}
+
+// lookupHash returns the hash of data, and the path identical data was
+// written to, if recorded via recordHash.
+func (st *state) lookupHash(data []byte) ([sha256.Size]byte, string, bool) {
+	sum := sha256.Sum256(data)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if original, ok := st.hashes[sum]; ok {
+		st.savedBytes += int64(len(data))
+		return sum, original, true
+	}
+	return sum, "", false
+}
+
+// recordHash records that the body with hash sum was written to path, unless
+// an identical body was recorded first.
+func (st *state) recordHash(sum [sha256.Size]byte, path string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.hashes == nil {
+		st.hashes = make(map[[sha256.Size]byte]string)
+	}
+	if _, ok := st.hashes[sum]; !ok {
+		st.hashes[sum] = path
+	}
+}
+
+// claimURL reserves path for the entry for rawURL, returning the URL it was
+// previously claimed for, if different. With suffix, a collision is instead
+// resolved by returning the first variant of path with a numeric suffix (-1,
+// -2, etc.) inserted before the extension that is unclaimed, or claimed for
+// rawURL.
+func (st *state) claimURL(path, rawURL string, suffix bool) (string, string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.urls == nil {
+		st.urls = make(map[string]string)
+	}
+	existing, ok := st.urls[path]
+	if !ok || existing == rawURL {
+		st.urls[path] = rawURL
+		return path, ""
+	}
+	if !suffix {
+		// the later entry takes the path
+		st.urls[path] = rawURL
+		return path, existing
+	}
+	base, ext := splitExt(path)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if existing, ok := st.urls[candidate]; !ok || existing == rawURL {
+			st.urls[candidate] = rawURL
+			return candidate, ""
+		}
+	}
+}
+
+// claimArchived reserves path within the Archive, returning false if it has
+// already been claimed, as archive members can't be replaced.
+func (st *state) claimArchived(path string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.archived[path] {
+		return false
+	}
+	if st.archived == nil {
+		st.archived = make(map[string]bool)
+	}
+	st.archived[path] = true
+	return true
+}
+
+// claimContent reserves and returns path for data, unless it has already
+// been claimed for different content, in which case a short hash of data is
+// inserted before the extension. The returned bool is true if the returned
+// path was previously claimed for identical content.
+func (st *state) claimContent(path string, data []byte) (string, bool) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.paths == nil {
+		st.paths = make(map[string]string)
+	}
+	if existing, ok := st.paths[path]; ok {
+		if existing == hash {
+			return path, true
+		}
+		base, ext := splitExt(path)
+		path = base + "-" + hash[:8] + ext
+		if existing, ok = st.paths[path]; ok && existing == hash {
+			return path, true
+		}
+	}
+	st.paths[path] = hash
+	return path, false
+}
+
+// matchStatus reports whether status falls within any of ranges.
+func matchStatus(ranges []StatusRange, status int) bool {
+	for _, r := range ranges {
+		if status >= r.Min && status <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMimeType reports whether mimeType, ignoring any parameters such as
+// charset, is in set, either exactly or via a "type/*" wildcard.
+func matchMimeType(set map[string]bool, mimeType string) bool {
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if set[mediaType] {
+		return true
+	}
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 && set[mediaType[:i]+"/*"] {
+		return true
+	}
+	return false
+}
+
+// matchQueryParams reports whether query has every one of params, where a
+// parameter given more than once matches if any of its values do.
+func matchQueryParams(params []QueryParam, query url.Values) bool {
+	for _, param := range params {
+		values, ok := query[param.Name]
+		if !ok {
+			return false
+		}
+		if !param.HasValue {
+			continue
+		}
+		var matched bool
+		for _, value := range values {
+			if value == param.Value {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// headerValue returns the value of the first header matching name, which is
+// compared case-insensitively.
+func headerValue(headers []Header, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// decodeContentEncoding reverses the (possibly multiple) encodings listed in
+// a Content-Encoding header value, e.g. "gzip" or "deflate, br".
+func decodeContentEncoding(data []byte, contentEncoding string) ([]byte, error) {
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var r io.Reader
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[i])); encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			gr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			r = gr
+		case "deflate":
+			// deflate is meant to be zlib wrapped, but some servers send it raw
+			if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+				r = zr
+			} else {
+				r = flate.NewReader(bytes.NewReader(data))
+			}
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(data))
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+		var err error
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// DefaultNameTemplate is the default Options.NameTemplate, which nests files
+// under their host and URL directory.
+const DefaultNameTemplate = "{{.Host}}/{{.Dir}}/{{.Name}}"
+
+var defaultNameTemplate = template.Must(ParseNameTemplate(DefaultNameTemplate))
+
+// ParseNameTemplate parses s as an Options.NameTemplate, failing if it
+// references fields other than those of NameFields.
+func ParseNameTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// catches references to unknown fields
+	if err := tmpl.Execute(io.Discard, NameFields{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// NameFields are the fields available to Options.NameTemplate.
+type NameFields struct {
+	Scheme string // e.g. "https"
+	Host   string // host directory, e.g. "example.com_8080", or "https/example.com/4xx" with SchemePrefix and StatusDir (and prefixed by the page directory, with ByPage)
+	Path   string // URL path, e.g. "/a/b.js"
+	Dir    string // URL path of the containing directory, e.g. "/a"
+	Name   string // default file name, e.g. "-a-b.js", or the IndexName
+	Base   string // last element of the URL path, e.g. "b.js"
+	Ext    string // extension of Base, e.g. ".js"
+	Query  string // raw query string, without the "?"
+	Status int
+	Method string
+}
+
+// hostDir returns the name of the directory for the host of u.
+func hostDir(u *url.URL, opts *Options) string {
+	host := u.Hostname()
+	if opts.LowercaseHosts {
+		host = strings.ToLower(host)
+	}
+	var domain string
+	if opts.RegisteredDomain {
+		domain = registeredDomain(host)
+	}
+	if opts.UnicodeHosts {
+		host = unicodeHost(host)
+		domain = unicodeHost(domain)
+	}
+	if strings.Contains(host, ":") {
+		// an IPv6 address, e.g. "2001-db8--1" for "[2001:db8::1]", as colons
+		// aren't permitted in Windows file names
+		host = strings.ReplaceAll(host, ":", "-")
+	}
+	if port := u.Port(); opts.KeepPort && port != "" {
+		host += "_" + port
+		if domain != "" {
+			domain += "_" + port
+		}
+	}
+	switch {
+	case domain == "":
+		return host
+	case opts.SubdomainDirs:
+		return domain + "/" + host
+	default:
+		return domain
+	}
+}
+
+// unicodeHost returns host with any punycode labels decoded, or host as is if
+// it has none, or they aren't valid.
+func unicodeHost(host string) string {
+	if lower := strings.ToLower(host); !strings.HasPrefix(lower, "xn--") && !strings.Contains(lower, ".xn--") {
+		return host
+	}
+	decoded, err := idna.Display.ToUnicode(host)
+	if err != nil {
+		return host
+	}
+	return safeFileName(decoded)
+}
+
+// registeredDomain returns the registered domain of host, per the public
+// suffix list, or "" if it has none, such as for IP addresses and
+// "localhost".
+func registeredDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(host))
+	if err != nil {
+		return ""
+	}
+	// preserving the case of host, as the lookup is case sensitive
+	if n := len(host) - len(domain); n >= 0 && strings.EqualFold(host[n:], domain) {
+		return host[n:]
+	}
+	return domain
+}
+
+// pageDir returns the name of the directory for the page of entry, given the
+// titles of pages by id. Pages without a title (or that aren't listed before
+// the entries) are named by id.
+func pageDir(entry *Entry, pages map[string]string) string {
+	if entry.PageRef == "" {
+		return "_nopage"
+	}
+	name := pages[entry.PageRef]
+	if name == "" {
+		name = entry.PageRef
+	}
+	// titles are often the page URL
+	name = safeFileName(name)
+	if name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// queryDir returns the name of the directory for the (still escaped) query of
+// a URL, with QueryAsDir.
+func queryDir(rawQuery string) string {
+	name := safeFileName(strings.NewReplacer("&", "_", ";", "_").Replace(rawQuery))
+	if name == "." || name == ".." {
+		name = "_"
+	}
+	return name
+}
+
+// decodedPath returns the path of u used to name output files. By default
+// this is u.Path, which url.Parse has already decoded, including any encoded
+// separators (e.g. %2F). With DecodePath, u is instead decoded one segment at
+// a time, so that encoded separators remain within their segment.
+func decodedPath(u *url.URL, opts *Options) string {
+	if !opts.DecodePath {
+		return u.Path
+	}
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segments[i] = safeFileName(decoded)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// stripPathPrefix returns the rooted URL path p without prefix, which must
+// match whole path segments, and whether it did.
+func stripPathPrefix(p, prefix string) (string, bool) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	switch {
+	case prefix == "/":
+		return p, true
+	case p == prefix:
+		return "/", true
+	case strings.HasPrefix(p, prefix+"/"):
+		return p[len(prefix):], true
+	default:
+		return "", false
+	}
+}
+
+// executeNameTemplate returns the relative output path produced by tmpl,
+// which should be slash-separated, with each element named via opts.fileName.
+func executeNameTemplate(tmpl *template.Template, fields NameFields, opts *Options) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", err
+	}
+	elements := strings.Split(b.String(), "/")
+	for i, element := range elements {
+		elements[i] = opts.fileName(element)
+	}
+	// ignores empty elements, such as those from a leading slash
+	relPath := filepath.Join(elements...)
+	if relPath == "" {
+		return "", fmt.Errorf("name template produced an empty path for %s%s", fields.Host, fields.Path)
+	}
+	return relPath, nil
+}
+
+// mimeExtensions overrides the extensions guessed by mime.ExtensionsByType,
+// for common types where it chooses poorly.
+var mimeExtensions = map[string]string{
+	"application/javascript": ".js",
+	"application/json":       ".json",
+	"application/xml":        ".xml",
+	"image/jpeg":             ".jpg",
+	"image/svg+xml":          ".svg",
+	"image/x-icon":           ".ico",
+	"text/css":               ".css",
+	"text/html":              ".html",
+	"text/javascript":        ".js",
+	"text/plain":             ".txt",
+	"text/xml":               ".xml",
+}
+
+// mimeExtension returns the file extension for mimeType, or an empty string
+// if there isn't a known extension.
+func mimeExtension(mimeType string) string {
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if ext, ok := mimeExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// splitExt splits path into the part before its extension and the extension.
+// Anything following the last dot that includes a "-" (as introduced by
+// safeFileName) is not considered to be an extension.
+func splitExt(path string) (string, string) {
+	ext := filepath.Ext(path)
+	if strings.Contains(ext, "-") {
+		ext = ""
+	}
+	return path[:len(path)-len(ext)], ext
+}
+
+// insertSuffix returns name with suffix inserted before its extension.
+func insertSuffix(name, suffix string) string {
+	if suffix == "" {
+		return name
+	}
+	base, ext := splitExt(name)
+	return base + suffix + ext
+}
+
+func safeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '-'
+		}
+		return r
+	}, s)
+}
+
+// shortenFileName returns the path element name, truncated to max bytes if
+// it is longer, with a short hash of name replacing the excess to keep it
+// unique. The extension is kept, unless it is too long. A max of zero is
+// unlimited.
+func shortenFileName(name string, max int) string {
+	if max <= 0 || len(name) <= max {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	base, ext := splitExt(name)
+	if len(suffix)+len(ext) >= max {
+		ext = ""
+	}
+	keep := max - len(suffix) - len(ext)
+	if keep < 0 {
+		keep = 0
+	}
+	// avoid splitting a multi-byte character
+	for keep > 0 && !utf8.RuneStart(base[keep]) {
+		keep--
+	}
+	return base[:keep] + suffix + ext
+}
+
+// fileName returns the output path element name, made ASCII with Slugify,
+// valid for the platform, and no longer than MaxFileNameLen.
+func (o *Options) fileName(name string) string {
+	if o.Slugify {
+		name = slugify(name)
+	}
+	return shortenFileName(platformFileName(name), o.MaxFileNameLen)
+}
+
+// cyrillic transliterates Cyrillic letters for slugify.
+var cyrillic = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g",
+}
+
+// slugify returns the path element name with only ASCII characters. Accents
+// are removed, Cyrillic letters are transliterated, and other non-ASCII
+// characters are replaced with "_", in which case a short hash of name is
+// appended (before the extension) to keep it unique.
+func slugify(name string) string {
+	var b strings.Builder
+	var lossy bool
+	// decomposes accented letters into their base letter and marks
+	for _, r := range norm.NFKD.String(name) {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+		} else if latin, ok := cyrillic[unicode.ToLower(r)]; ok {
+			if unicode.IsUpper(r) && latin != "" {
+				latin = strings.ToUpper(latin[:1]) + latin[1:]
+			}
+			b.WriteString(latin)
+		} else if !unicode.Is(unicode.Mn, r) {
+			b.WriteByte('_')
+			lossy = true
+		}
+	}
+	if !lossy {
+		return b.String()
+	}
+	sum := sha256.Sum256([]byte(name))
+	base, ext := splitExt(b.String())
+	return base + "-" + hex.EncodeToString(sum[:4]) + ext
+}
+
+// windowsFileNames enables platformFileName.
+var windowsFileNames = runtime.GOOS == "windows"
+
+// platformFileName returns windowsFileName(name) on Windows, otherwise name.
+func platformFileName(name string) string {
+	if !windowsFileNames {
+		return name
+	}
+	return windowsFileName(name)
+}
+
+// windowsReservedNames are device names that Windows reserves, with or
+// without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// windowsFileName makes the path element name valid on Windows, replacing
+// the characters it forbids with "_", trimming the trailing dots and spaces
+// that it would otherwise strip silently, and appending "_" to reserved
+// device names, e.g. "con.txt" becomes "con_.txt". The elements "." and ".."
+// are returned unchanged.
+func windowsFileName(name string) string {
+	if name == "." || name == ".." {
+		return name
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name = strings.TrimRight(name, ". "); name == "" {
+		// the element must not be dropped
+		name = "_"
+	}
+	base, ext, _ := strings.Cut(name, ".")
+	if windowsReservedNames[strings.ToUpper(base)] {
+		name = base + "_"
+		if ext != "" {
+			name += "." + ext
+		}
+	}
+	return name
+}
+
+// readHar decompresses the HAR read from r, if necessary, then processes it.
+// The size of r is zero if unknown.
+func readHar(ctx context.Context, r io.Reader, size int64, opts *Options, st *state) (Stats, error) {
+	reader, err := decompressHar(r, opts.bufferSize())
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if _, ok := reader.(*gzip.Reader); ok {
+		// the decoder offset is into the decompressed stream
+		size = 0
+	}
+
+	return processHar(ctx, skipBOM(reader, opts.bufferSize()), size, opts, st)
+}
+
+// skipBOM returns a reader over r, skipping any leading UTF-8 byte order
+// mark, as written by some Windows tools. A buffer of bufSize bytes is added,
+// unless r is already buffered.
+func skipBOM(r io.Reader, bufSize int) io.Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, bufSize)
+	}
+	if b, err := br.Peek(3); err == nil && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf {
+		_, _ = br.Discard(3)
+	}
+	return br
+}
+
+// decompressHar returns a reader over the HAR content of r, transparently
+// decompressing it if it starts with the gzip magic number. The input is read
+// through a buffer of bufSize bytes.
+func decompressHar(r io.Reader, bufSize int) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, bufSize)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// dataDir is the host directory for data URIs, which are named by a hash of
+// the URI.
+const dataDir = "_data"
+
+// sizeTolerance is the fraction by which the length of a body may differ from
+// the recorded content size, with VerifySize.
+const sizeTolerance = 0.01
+
+// progressInterval is the number of entries between progress reports.
+const progressInterval = 1000
+
+// writeRetryDelay is the delay before the first retry of a write, with
+// WriteRetries, which doubles for each subsequent retry.
+const writeRetryDelay = 100 * time.Millisecond
+
+// processHar extracts the entries of the HAR read from reader. The size of
+// the HAR, if known, is used to estimate the remaining time for progress
+// reports, and may otherwise be zero. The Stats are valid even if an error is
+// returned.
+func processHar(ctx context.Context, reader io.Reader, size int64, opts *Options, st *state) (Stats, error) {
+	var res Stats
+	if st.limitReached(opts.Limit) {
+		return res, nil
+	}
+
+	decoder := json.NewDecoder(reader)
+
+	var info logInfo
+	if err := findEntries(decoder, &info, opts.Strict); err != nil {
+		return res, err
+	}
+	if opts.Verbose && info.Version != "" {
+		text := "HAR version " + info.Version
+		if info.Creator.Name != "" {
+			text += ", created by " + info.Creator.Name
+		}
+		opts.event(Event{
+			Level:  LevelInfo,
+			Msg:    "HAR version",
+			Fields: []Field{field("version", info.Version), field("creator", info.Creator.Name)},
+			Text:   text,
+		})
+	}
+	if opts.Creator != "" && !strings.Contains(strings.ToLower(info.Creator.Name), strings.ToLower(opts.Creator)) {
+		// the entries are left unread
+		return res, fmt.Errorf("%w: %q", ErrCreatorMismatch, info.Creator.Name)
+	}
+	if info.Version != "" && info.Version != supportedVersion {
+		opts.log(LevelWarn, "unsupported HAR version, entries may not be extracted as expected", field("version", info.Version))
+	}
+
+	var pages map[string]string
+	if opts.ByPage {
+		pages = make(map[string]string, len(info.Pages))
+		for _, page := range info.Pages {
+			pages[page.ID] = page.Title
+		}
+	}
+
+	if err := processEntries(ctx, decoder, size, pages, opts, st, &res); err != nil {
+		return res, err
+	}
+
+	if st.limitReached(opts.Limit) {
+		// the remaining entries, if any, are left unread
+		return res, nil
+	}
+
+	// Expect the next token to be the closing bracket ]
+	if _, err := decoder.Token(); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// ErrNoEntries is returned for input without a log.entries array, such as a
+// JSON document that isn't a HAR.
+var ErrNoEntries = errors.New(`no "entries" array found in HAR`)
+
+// ErrCreatorMismatch is returned for a HAR not created by the tool named by
+// Options.Creator.
+var ErrCreatorMismatch = errors.New("created by a different tool")
+
+// supportedVersion is the HAR format version entries are decoded as.
+const supportedVersion = "1.2"
+
+// logInfo holds the fields of the HAR log object preceding its entries.
+type logInfo struct {
+	Version string `json:"version"`
+	Creator struct {
+		Name string `json:"name"`
+	} `json:"creator"`
+	Pages []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"pages"`
+}
+
+// findEntries advances decoder into the log.entries array of the HAR, for
+// which an "entries" key at the top level is also accepted. Other values are
+// skipped without matching anything within them, except for the log fields
+// of info that precede the entries, which are decoded into it. If strict,
+// the entries must be within the log object.
+func findEntries(decoder *json.Decoder, info *logInfo, strict bool) error {
+	if err := expectDelim(decoder, '{'); err == io.EOF {
+		// empty input
+		return ErrNoEntries
+	} else if err != nil {
+		return err
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "entries":
+			if strict {
+				return errors.New(`invalid HAR: "entries" must be within the "log" object`)
+			}
+			return expectDelim(decoder, '[')
+		case "log":
+			if err := expectDelim(decoder, '{'); err != nil {
+				return err
+			}
+			for decoder.More() {
+				if key, err = decoder.Token(); err != nil {
+					return err
+				}
+				switch key {
+				case "entries":
+					return expectDelim(decoder, '[')
+				case "version":
+					err = decoder.Decode(&info.Version)
+				case "creator":
+					err = decoder.Decode(&info.Creator)
+				case "pages":
+					err = decoder.Decode(&info.Pages)
+				default:
+					err = skipValue(decoder)
+				}
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					// the value has been consumed, and is only informational
+					err = nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return ErrNoEntries
+		}
+		if err := skipValue(decoder); err != nil {
+			return err
+		}
+	}
+	if strict {
+		return errors.New(`invalid HAR: no "log" object found`)
+	}
+	return ErrNoEntries
+}
+
+// expectDelim reads the next token from decoder, which must be delim.
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("invalid HAR: expected %q at offset %d, got %v", delim, decoder.InputOffset(), token)
+	}
+	return nil
+}
+
+// skipValue reads and discards the next value from decoder.
+func skipValue(decoder *json.Decoder) error {
+	var depth int
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// processEntries decodes and processes each remaining element of the array
+// decoder is positioned within. Entries are decoded sequentially, and fanned
+// out to opts.Concurrency workers. Processing stops after the first error, or
+// if ctx is canceled, and the returned error joins every error that occurred.
+// With ByPage, pages holds the title of each page by id.
+func processEntries(ctx context.Context, decoder *json.Decoder, size int64, pages map[string]string, opts *Options, st *state, res *Stats) error {
+	workers := opts.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mu      sync.Mutex
+		errs    []error
+		wg      sync.WaitGroup
+		entries = make(chan rawEntry)
+		stop    = make(chan struct{})
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for raw := range entries {
+				written, reason, err := processEntry(&raw, opts, st)
+				mu.Lock()
+				if err != nil && opts.SkipErrors {
+					opts.log(LevelError, "Failed to process entry", field("url", raw.entry.Request.URL), field("error", err))
+					res.Entries++
+					res.Failed++
+				} else if err != nil {
+					if len(errs) == 0 {
+						close(stop)
+					}
+					errs = append(errs, err)
+				} else {
+					res.record(written, reason, opts)
+					if written != nil && opts.OnWritten != nil {
+						st.hooks.Lock()
+						opts.OnWritten(*written)
+						st.hooks.Unlock()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var readErr error
+	var decoded int
+	start := time.Now()
+loop:
+	for decoder.More() && !st.limitReached(opts.Limit) {
+		if readErr = ctx.Err(); readErr != nil {
+			break
+		}
+		var lazy lazyEntry
+		if readErr = decoder.Decode(&lazy); readErr != nil {
+			break
+		}
+		entry, text := lazy.split()
+		if opts.Strict && entry.Request.URL == "" {
+			readErr = fmt.Errorf("invalid HAR: entry %d, ending at offset %d, has no request URL", decoded, decoder.InputOffset())
+			break
+		}
+		var page string
+		if opts.ByPage {
+			page = pageDir(&entry, pages)
+		}
+		if decoded++; opts.Progress && decoded%progressInterval == 0 {
+			reportProgress(opts, decoded, decoder.InputOffset(), size, time.Since(start))
+		}
+		if opts.OnEntry != nil {
+			// the hook may inspect the text, so it can't be deferred
+			if text != nil {
+				if readErr = json.Unmarshal(text, &entry.Response.Content.Text); readErr != nil {
+					break
+				}
+				text = nil
+			}
+			st.hooks.Lock()
+			skip, err := opts.OnEntry(&entry)
+			st.hooks.Unlock()
+			if readErr = err; readErr != nil {
+				break
+			}
+			if skip {
+				mu.Lock()
+				res.record(nil, SkipReasonHook, opts)
+				mu.Unlock()
+				continue
+			}
+		}
+		select {
+		case entries <- rawEntry{entry, text, page, decoded - 1}:
+		case <-stop:
+			break loop
+		case <-ctx.Done():
+			readErr = ctx.Err()
+			break loop
+		}
+	}
+
+	close(entries)
+	wg.Wait()
+
+	if readErr != nil {
+		errs = append(errs, readErr)
+	}
+	return errors.Join(errs...)
+}
+
+// reportProgress logs a progress message, after decoding the given number of
+// entries and reading offset bytes of a HAR of the given size (zero if
+// unknown).
+func reportProgress(opts *Options, entries int, offset int64, size int64, elapsed time.Duration) {
+	rate := float64(offset) / elapsed.Seconds()
+	text := fmt.Sprintf("Progress: %d entries, %s read (%s/s)", entries, FormatBytes(offset), FormatBytes(int64(rate)))
+	fields := []Field{field("entries", entries), field("bytesRead", offset), field("bytesPerSecond", int64(rate))}
+	if size > 0 && rate > 0 {
+		eta := time.Duration(float64(size-offset) / rate * float64(time.Second)).Round(time.Second)
+		text += fmt.Sprintf(", ETA %s", eta)
+		fields = append(fields, field("eta", eta.String()))
+	}
+	opts.event(Event{Level: LevelInfo, Msg: "Progress", Fields: fields, Text: text})
+}
+
+// FormatBytes formats n as a human readable size, e.g. "1.5 MB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// processEntry extracts the response content of entry, returning a record of
+// what was written (or would have been, in dry run mode), or nil and the
+// reason if skipped.
+// If the text of raw is non-nil, it's the raw JSON of the response text, which
+// is decoded once the filters have been applied. If the page is non-empty,
+// it's the page directory output is nested under. The text of raw is released
+// once decoded, so that only the decoded copy is retained.
+func processEntry(raw *rawEntry, opts *Options, st *state) (*ManifestEntry, SkipReason, error) {
+	entry, text, page, index := raw.entry, raw.text, raw.page, raw.index
+	parsedUrl, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	// fragments are never sent to the server, so don't distinguish responses
+	parsedUrl.Fragment, parsedUrl.RawFragment = "", ""
+
+	if len(opts.HostAllowlist) > 0 {
+		if !opts.HostAllowlist[parsedUrl.Host] {
+			return nil, SkipReasonHost, nil
+		}
+	}
+
+	if opts.HostDenylist[parsedUrl.Host] {
+		return nil, SkipReasonHost, nil
+	}
+
+	// data URIs have no host or path, and embed the content in the URL
+	isData := strings.EqualFold(parsedUrl.Scheme, "data")
+	if isData && opts.SkipDataURIs {
+		return nil, SkipReasonDataURI, nil
+	}
+
+	if len(opts.MimeTypes) > 0 && !matchMimeType(opts.MimeTypes, entry.Response.Content.MimeType) {
+		return nil, SkipReasonMimeType, nil
+	}
+
+	if len(opts.Statuses) > 0 && !matchStatus(opts.Statuses, entry.Response.Status) {
+		return nil, SkipReasonStatus, nil
+	}
+
+	if opts.SkipRedirects && entry.Response.Status >= 300 && entry.Response.Status <= 399 {
+		return nil, SkipReasonRedirect, nil
+	}
+
+	if len(opts.Methods) > 0 && !opts.Methods[strings.ToUpper(entry.Request.Method)] {
+		return nil, SkipReasonMethod, nil
+	}
+
+	if len(opts.ResourceTypes) > 0 && !opts.ResourceTypes[strings.ToLower(entry.ResourceType)] {
+		return nil, SkipReasonResourceType, nil
+	}
+
+	if opts.URLInclude != nil && !opts.URLInclude.MatchString(entry.Request.URL) {
+		return nil, SkipReasonURL, nil
+	}
+
+	if opts.URLExclude != nil && opts.URLExclude.MatchString(entry.Request.URL) {
+		return nil, SkipReasonURL, nil
+	}
+
+	if len(opts.QueryParams) > 0 && !matchQueryParams(opts.QueryParams, parsedUrl.Query()) {
+		return nil, SkipReasonQuery, nil
+	}
+
+	if !opts.After.IsZero() || !opts.Before.IsZero() {
+		// entries that are missing or have an invalid timestamp are kept
+		if t, err := time.Parse(time.RFC3339, entry.StartedDateTime); err == nil {
+			if (!opts.After.IsZero() && t.Before(opts.After)) || (!opts.Before.IsZero() && !t.Before(opts.Before)) {
+				return nil, SkipReasonTime, nil
+			}
+		}
+	}
+
+	if encoding := entry.Response.Content.Encoding; encoding != "base64" && encoding != "quoted-printable" && !isPlainEncoding(encoding) {
+		if opts.Strict {
+			opts.log(LevelWarn, "Skipping (unsupported content encoding)", field("url", entry.Request.URL), field("encoding", encoding))
+			return nil, SkipReasonEncoding, nil
+		}
+		opts.log(LevelWarn, "unsupported content encoding, writing as plain text", field("url", entry.Request.URL), field("encoding", encoding))
+	}
+
+	if text != nil {
+		// deferred until the entry has passed the filters, as it may be large
+		if err := json.Unmarshal(text, &entry.Response.Content.Text); err != nil {
+			return nil, "", fmt.Errorf("decoding response text: %w", err)
+		}
+		raw.text, text = nil, nil
+	}
+
+	if opts.SkipEmpty && entry.Response.Content.Text == "" {
+		if opts.Verbose {
+			opts.log(LevelInfo, "Skipping (empty)", field("url", entry.Request.URL))
+		}
+		return nil, SkipReasonEmpty, nil
+	}
+
+	if opts.RemoveQueryString {
+		parsedUrl.RawQuery = ""
+	}
+
+	// Size may be inaccurate, so it's checked again after decoding
+	if opts.MaxSize > 0 && int64(entry.Response.Content.Size) > opts.MaxSize {
+		if opts.Verbose {
+			opts.log(LevelInfo, "Skipping (too large)", field("url", entry.Request.URL))
+		}
+		return nil, SkipReasonTooLarge, nil
+	}
+
+	// base64 bodies are decoded as they are written, where the decoded body
+	// isn't otherwise needed, saving a copy of potentially large bodies
+	var data []byte
+	stream, size := streamEncoding(entry, opts)
+	if stream == nil {
+		if data, err = responseBody(entry, opts); err != nil {
+			return nil, "", err
+		}
+		size = len(data)
+	}
+
+	if opts.MaxSize > 0 && int64(size) > opts.MaxSize {
+		if opts.Verbose {
+			opts.log(LevelInfo, "Skipping (too large)", field("url", entry.Request.URL))
+		}
+		return nil, SkipReasonTooLarge, nil
+	}
+
+	if int64(size) < opts.MinSize {
+		if opts.Verbose {
+			opts.log(LevelInfo, "Skipping (too small)", field("url", entry.Request.URL))
+		}
+		return nil, SkipReasonTooSmall, nil
+	}
+
+	urlPath := decodedPath(parsedUrl, opts)
+	if isData {
+		sum := sha256.Sum256([]byte(entry.Request.URL))
+		urlPath = "/" + hex.EncodeToString(sum[:8])
+	}
+	if urlPath != "" {
+		// collapses empty and "." segments, and resolves ".." segments, which
+		// can't escape the (rooted) path
+		cleaned := path.Clean("/" + urlPath)
+		if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		urlPath = cleaned
+	}
+
+	if opts.StripPathPrefix != "" && !isData {
+		if stripped, ok := stripPathPrefix(urlPath, opts.StripPathPrefix); ok {
+			urlPath = stripped
+		} else if opts.SkipUnprefixed {
+			if opts.Verbose {
+				opts.log(LevelInfo, "Skipping (path prefix)", field("url", entry.Request.URL))
+			}
+			return nil, SkipReasonPathPrefix, nil
+		}
+	}
+
+	if opts.QueryAsDir && parsedUrl.RawQuery != "" {
+		urlPath = strings.TrimSuffix(urlPath, "/") + "/" + queryDir(parsedUrl.RawQuery) + "/"
+	}
+
+	// directory style URLs are written to an index file within the directory
+	isIndex := urlPath == "" || strings.HasSuffix(urlPath, "/")
+
+	host := hostDir(parsedUrl, opts)
+	if isData {
+		host = dataDir
+	}
+	if opts.SchemePrefix && parsedUrl.Scheme != "" {
+		host = parsedUrl.Scheme + "/" + host
+	}
+	if page != "" {
+		host = page + "/" + host
+	}
+	switch opts.StatusDir {
+	case StatusDirClass:
+		host += fmt.Sprintf("/%dxx", entry.Response.Status/100)
+	case StatusDirExact:
+		host += fmt.Sprintf("/%d", entry.Response.Status)
+	}
+
+	var ext string
+	if (opts.AddExtension || isData) && !isIndex && path.Ext(path.Base(urlPath)) == "" {
+		ext = mimeExtension(entry.Response.Content.MimeType)
+	}
+
+	indexName := opts.IndexName
+	if indexName == "" {
+		indexName = "index.html"
+	}
+
+	// distinguishes responses differing only by query, with QueryHash
+	var queryHash string
+	if opts.QueryHash && parsedUrl.RawQuery != "" {
+		sum := sha256.Sum256([]byte(parsedUrl.RawQuery))
+		queryHash = "-" + hex.EncodeToString(sum[:4])
+	}
+
+	var relPath string
+	if opts.Flatten {
+		flatName := host + urlPath
+		if isIndex {
+			flatName = strings.TrimSuffix(flatName, "/") + "/" + indexName
+		}
+		relPath = opts.fileName(insertSuffix(safeFileName(flatName)+ext, queryHash))
+		if !opts.DedupeSuffix {
+			// collisions are likely, without the directory structure, so are
+			// always resolved by suffixes, keyed on the parsed URL so that
+			// repeated URLs share a path
+			relPath, _ = st.claimURL(relPath, parsedUrl.String(), true)
+		}
+	} else {
+		fields := NameFields{
+			Scheme: parsedUrl.Scheme,
+			Host:   host,
+			Path:   urlPath,
+			Dir:    path.Dir(urlPath),
+			Name:   safeFileName(urlPath) + ext,
+			Base:   path.Base(urlPath) + ext,
+			Query:  parsedUrl.RawQuery,
+			Status: entry.Response.Status,
+			Method: entry.Request.Method,
+		}
+		if isIndex {
+			fields.Dir = urlPath
+			fields.Name = indexName
+			fields.Base = indexName
+		}
+		fields.Name = insertSuffix(fields.Name, queryHash)
+		fields.Base = insertSuffix(fields.Base, queryHash)
+		fields.Ext = path.Ext(fields.Base)
+		tmpl := opts.NameTemplate
+		if tmpl == nil {
+			tmpl = defaultNameTemplate
+		}
+		if relPath, err = executeNameTemplate(tmpl, fields, opts); err != nil {
+			return nil, "", err
+		}
+	}
+	if opts.ErrorsDir != "" && entry.Response.Status >= 400 {
+		relPath = filepath.Join(opts.ErrorsDir, relPath)
+	}
+	if opts.PathPrefix != "" {
+		relPath = filepath.Join(opts.PathPrefix, relPath)
+	}
+
+	if ext := strings.ToLower(filepath.Ext(relPath)); (len(opts.IncludeExtensions) > 0 && !opts.IncludeExtensions[ext]) || opts.ExcludeExtensions[ext] {
+		if opts.Verbose {
+			opts.log(LevelInfo, "Skipping (extension)", field("url", entry.Request.URL))
+		}
+		return nil, SkipReasonExtension, nil
+	}
+	if opts.DedupeSuffix {
+		var duplicate bool
+		if relPath, duplicate = st.claimContent(relPath, data); duplicate {
+			if opts.Verbose {
+				opts.log(LevelInfo, "Skipping (duplicate)", field("path", filepath.Join(opts.RootDir, relPath)))
+			}
+			return nil, SkipReasonDuplicate, nil
+		}
+	}
+
+	// flattened and deduplicated paths are already unique
+	if !opts.Flatten && !opts.DedupeSuffix {
+		var other string
+		// keyed on the parsed URL, so that fragments don't cause collisions
+		relPath, other = st.claimURL(relPath, parsedUrl.String(), opts.OnCollision == CollisionSuffix)
+		if other != "" {
+			switch opts.OnCollision {
+			case CollisionError:
+				return nil, "", fmt.Errorf("output path collision: %s and %s both map to %s", other, entry.Request.URL, relPath)
+			case CollisionOverwrite:
+			default:
+				msg := "overwriting the output of a different URL"
+				if opts.Archive != nil {
+					// archive members can't be replaced
+					msg = "keeping the archived output of a different URL"
+				}
+				opts.log(LevelWarn, msg, field("path", relPath), field("url", entry.Request.URL), field("previous", other))
+			}
+		}
+	}
+
+	// crafted URLs (e.g. containing "..") must not escape the output directory
+	if !filepath.IsLocal(relPath) {
+		return nil, "", fmt.Errorf("refusing to write outside the output directory: %s", entry.Request.URL)
+	}
+
+	filePath := filepath.Join(opts.RootDir, relPath)
+	if opts.Archive != nil {
+		filePath = filepath.ToSlash(relPath)
+	} else if !opts.DryRun || opts.DirsOnly {
+		err = os.MkdirAll(filepath.Dir(filePath), opts.dirMode())
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if opts.NoClobber && opts.Archive == nil {
+		if _, err := os.Stat(filePath); err == nil {
+			if opts.Verbose {
+				opts.log(LevelInfo, "Skipping (exists)", field("path", filePath))
+			}
+			return nil, SkipReasonExists, nil
+		}
+	}
+
+	var linkTarget string
+	var sum [sha256.Size]byte
+	if opts.Dedupe {
+		var original string
+		var duplicate bool
+		if sum, original, duplicate = st.lookupHash(data); duplicate {
+			// a repeated URL would otherwise be replaced by a link to itself
+			if original == relPath || !opts.DedupeSymlink || opts.Archive != nil {
+				if opts.Verbose {
+					opts.log(LevelInfo, "Skipping (duplicate)", field("path", filePath))
+				}
+				return nil, SkipReasonDuplicate, nil
+			}
+			if linkTarget, err = filepath.Rel(filepath.Dir(relPath), original); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	// only the first of the entries sharing an output path is archived
+	if opts.Archive != nil && !st.claimArchived(relPath) {
+		if opts.Verbose {
+			opts.log(LevelInfo, "Skipping (already archived)", field("path", filePath))
+		}
+		return nil, SkipReasonExists, nil
+	}
+
+	if !st.claimWrite(opts.Limit) {
+		return nil, SkipReasonLimit, nil
+	}
+
+	if opts.Verbose {
+		if linkTarget != "" {
+			opts.log(LevelInfo, "Linking", field("path", filePath), field("target", linkTarget))
+		} else {
+			opts.event(Event{
+				Level:  LevelInfo,
+				Msg:    "Processing",
+				Fields: []Field{field("path", filePath), field("url", entry.Request.URL)},
+				Text:   "Processing: " + filePath,
+			})
+		}
+	}
+
+	if content := entry.Response.Content; opts.VerifySize && content.Size > 0 &&
+		math.Abs(float64(size-content.Size)) > sizeTolerance*float64(content.Size) {
+		opts.log(LevelWarn, "body size differs from the recorded content size", field("url", entry.Request.URL), field("bytes", size), field("size", content.Size))
+	}
+
+	written := &ManifestEntry{
+		Index:      index,
+		URL:        entry.Request.URL,
+		Method:     entry.Request.Method,
+		Host:       parsedUrl.Host,
+		Status:     entry.Response.Status,
+		MimeType:   entry.Response.Content.MimeType,
+		OutputPath: filepath.ToSlash(relPath),
+		Bytes:      size,
+	}
+
+	if !opts.DryRun && opts.Archive == nil {
+		// entries sharing the path (e.g. repeated URLs) may be processed
+		// concurrently, and the last must leave its body whole
+		unlock := st.lockPath(relPath)
+		defer unlock()
+	}
+
+	switch {
+	case opts.DryRun:
+	case linkTarget != "":
+		if err := writeSymlink(linkTarget, filePath); err != nil {
+			return nil, "", err
+		}
+	default:
+		var modTime time.Time
+		if opts.PreserveTime {
+			// timestamps that are missing or invalid are ignored
+			modTime, _ = time.Parse(time.RFC3339, entry.StartedDateTime)
+		}
+		err := retryWrite(filePath, opts, func() error {
+			var body io.Reader = bytes.NewReader(data)
+			if stream != nil {
+				body = base64.NewDecoder(stream, strings.NewReader(entry.Response.Content.Text))
+			}
+			return opts.writeFile(filePath, body, int64(size), modTime)
+		})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if opts.Dedupe && linkTarget == "" {
+		// later duplicates are only linked to bodies written successfully
+		st.recordHash(sum, relPath)
+	}
+
+	if opts.LinkRedirects && !opts.DryRun && opts.Archive == nil {
+		var target *url.URL
+		if status := entry.Response.Status; status >= 300 && status <= 399 && entry.Response.RedirectURL != "" {
+			if u, err := parsedUrl.Parse(entry.Response.RedirectURL); err == nil {
+				target = u
+			}
+		}
+		st.recordWrite(parsedUrl, relPath, target)
+	}
+
+	if opts.ExtractRequests && entry.Request.PostData != nil {
+		if err := writeSidecar(filePath+".request", []byte(entry.Request.PostData.Text), opts); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if opts.SaveHeaders {
+		var headers bytes.Buffer
+		for _, h := range entry.Response.Headers {
+			fmt.Fprintf(&headers, "%s: %s\n", h.Name, h.Value)
+		}
+		if err := writeSidecar(filePath+".headers", headers.Bytes(), opts); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if opts.ExtractWebSockets && len(entry.WebSocketMessages) > 0 {
+		if err := writeWebSocketFrames(filePath+".ws", entry.WebSocketMessages, opts); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return written, "", nil
+}
+
+// writeSidecar writes data to path, a file accompanying an extracted
+// response.
+func writeSidecar(path string, data []byte, opts *Options) error {
+	if opts.Verbose {
+		opts.log(LevelInfo, "Processing", field("path", path))
+	}
+	if opts.DryRun {
+		return nil
+	}
+	return retryWrite(path, opts, func() error {
+		return opts.writeFile(path, bytes.NewReader(data), int64(len(data)), time.Time{})
+	})
+}
+
+// writeWebSocketFrames writes each of messages to a file in dir, numbered in
+// order, and named for the direction of the frame, e.g. "01-send.txt". Text
+// frames have a .txt extension, and other frames are decoded from base64,
+// with a .bin extension.
+func writeWebSocketFrames(dir string, messages []WSMessage, opts *Options) error {
+	join := filepath.Join
+	if opts.Archive != nil {
+		join = path.Join
+	} else if !opts.DryRun || opts.DirsOnly {
+		if err := os.MkdirAll(dir, opts.dirMode()); err != nil {
+			return err
+		}
+	}
+	// zero padded, so that the files sort in order
+	width := len(strconv.Itoa(len(messages)))
+	for i, msg := range messages {
+		data := []byte(msg.Data)
+		ext := ".txt"
+		if msg.Opcode != 1 {
+			var err error
+			if data, err = decodeBase64(msg.Data); err != nil {
+				return fmt.Errorf("decoding WebSocket frame %d: %w", i+1, err)
+			}
+			ext = ".bin"
+		}
+		name := fmt.Sprintf("%0*d-%s%s", width, i+1, platformFileName(safeFileName(msg.Type)), ext)
+		if err := writeSidecar(join(dir, name), data, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSymlink creates a symlink at path pointing to target, replacing any
+// existing file.
+func writeSymlink(target, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// replaceWithSymlink atomically replaces the file at path with a symlink to
+// target, leaving it in place if the symlink can't be created.
+func replaceWithSymlink(target, path string) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".link.tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeFile writes the size bytes of r to path, as configured by o, which is
+// the name within the Archive, if any. The modification time is set to
+// modTime, if non-zero.
+func (o *Options) writeFile(path string, r io.Reader, size int64, modTime time.Time) error {
+	if o.Archive != nil {
+		return o.Archive.WriteFile(path, r, size, modTime)
+	}
+	var err error
+	if o.Atomic {
+		err = writeFileAtomic(path, r, o.fileMode())
+	} else {
+		err = writeFile(path, r, o.fileMode())
+	}
+	if err == nil && !modTime.IsZero() {
+		err = os.Chtimes(path, modTime, modTime)
+	}
+	return err
+}
+
+// retryWrite calls write, the write of the file at path, until it succeeds,
+// fails with an error that isn't transient, or has been retried
+// opts.WriteRetries times.
+func retryWrite(path string, opts *Options, write func() error) error {
+	delay := writeRetryDelay
+	for retries := 0; ; retries++ {
+		err := write()
+		if err == nil || retries >= opts.WriteRetries || opts.Archive != nil || !isTransient(err) {
+			return err
+		}
+		opts.log(LevelWarn, "retrying write after a transient error", field("path", path), field("error", err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isTransient reports whether err is a file system error that may succeed if
+// retried.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EINTR)
+}
+
+// writeFileAtomic writes the content of r to a temporary file in the same
+// directory as path, then renames it to path, so that path is never
+// partially written. The temporary file is removed on failure.
+func writeFileAtomic(path string, r io.Reader, perm os.FileMode) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	_, err = io.Copy(file, r)
+	if err == nil {
+		// CreateTemp uses 0600
+		err = file.Chmod(perm)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	return err
+}
+
+// writeFile creates (with the given permissions) or truncates the file at
+// path, and writes the content of r to it. The file is removed if writing
+// fails.
+func writeFile(path string, r io.Reader, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		// a partial file would be mistaken for a complete one
+		_ = os.Remove(path)
+	}
+
+	return err
+}
+
+// ResponseBody returns the response content of entry, decoded as it would be
+// extracted with opts, which may be nil.
+func ResponseBody(entry Entry, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return responseBody(entry, opts)
+}
+
+// responseBody returns the decoded response content of entry.
+func responseBody(entry Entry, opts *Options) ([]byte, error) {
+	var data []byte
+	switch entry.Response.Content.Encoding {
+	case "base64":
+		var err error
+		data, err = decodeBase64(entry.Response.Content.Text)
+		if err != nil {
+			return nil, err
+		}
+	case "quoted-printable":
+		var err error
+		data, err = io.ReadAll(quotedprintable.NewReader(strings.NewReader(entry.Response.Content.Text)))
+		if err != nil {
+			opts.log(LevelWarn, "failed to decode quoted-printable content, writing raw text", field("url", entry.Request.URL), field("error", err))
+			data = []byte(entry.Response.Content.Text)
+		}
+	default:
+		data = []byte(entry.Response.Content.Text)
+	}
+
+	if opts.DecodeContentEncoding {
+		if contentEncoding := headerValue(entry.Response.Headers, "Content-Encoding"); contentEncoding != "" {
+			if decoded, err := decodeContentEncoding(data, contentEncoding); err != nil {
+				opts.log(LevelWarn, "failed to decode content encoding, writing raw bytes", field("url", entry.Request.URL), field("error", err))
+			} else {
+				data = decoded
+			}
+		}
+	}
+
+	return data, nil
+}
+
+// isPlainEncoding reports whether the response content encoding is one of
+// those used for unencoded text.
+func isPlainEncoding(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "", "none", "identity":
+		return true
+	}
+	return false
+}
+
+// streamEncoding returns the encoding of the base64 response content of
+// entry, if it may be decoded as it is written, along with the decoded size.
+// Otherwise, it returns nil, and the content must be decoded by
+// responseBody, e.g. as it is needed for deduplication, or is invalid.
+func streamEncoding(entry Entry, opts *Options) (*base64.Encoding, int) {
+	if entry.Response.Content.Encoding != "base64" || opts.DryRun || opts.Dedupe || opts.DedupeSuffix ||
+		(opts.DecodeContentEncoding && headerValue(entry.Response.Headers, "Content-Encoding") != "") {
+		return nil, 0
+	}
+
+	// the decoders ignore newlines
+	text := entry.Response.Content.Text
+	n := len(text) - strings.Count(text, "\n") - strings.Count(text, "\r")
+	trimmed := strings.TrimRight(text, "\r\n")
+	padding := len(trimmed) - len(strings.TrimRight(trimmed, "="))
+	urlSafe := strings.ContainsAny(text, "-_")
+
+	switch {
+	case n%4 == 0:
+		if urlSafe {
+			return base64.URLEncoding, n/4*3 - padding
+		}
+		return base64.StdEncoding, n/4*3 - padding
+	case padding == 0 && n%4 != 1:
+		if urlSafe {
+			return base64.RawURLEncoding, base64.RawURLEncoding.DecodedLen(n)
+		}
+		return base64.RawStdEncoding, base64.RawStdEncoding.DecodedLen(n)
+	default:
+		return nil, 0
+	}
+}
+
+// base64Fallbacks are tried in order when text is not valid standard base64,
+// as some HAR generators omit padding or use the URL-safe alphabet.
+var base64Fallbacks = []*base64.Encoding{
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeBase64 decodes text as standard base64, falling back to each of
+// base64Fallbacks. The error from the standard encoding is returned if none
+// succeed.
+func decodeBase64(text string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err == nil {
+		return data, nil
+	}
+	for _, enc := range base64Fallbacks {
+		if data, fallbackErr := enc.DecodeString(text); fallbackErr == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
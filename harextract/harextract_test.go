@@ -0,0 +1,911 @@
+package harextract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// newHar returns the JSON encoding of a HAR containing entries.
+func newHar(t testing.TB, entries ...Entry) []byte {
+	t.Helper()
+	if entries == nil {
+		entries = []Entry{}
+	}
+	var har struct {
+		Log struct {
+			Entries []Entry `json:"entries"`
+		} `json:"log"`
+	}
+	har.Log.Entries = entries
+	b, err := json.Marshal(har)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newEntry returns a GET entry for url, with a 200 response of text.
+func newEntry(url, mimeType, text string) Entry {
+	var e Entry
+	e.Request.Method = "GET"
+	e.Request.URL = url
+	e.Response.Status = 200
+	e.Response.Content.MimeType = mimeType
+	e.Response.Content.Text = text
+	e.Response.Content.Size = len(text)
+	return e
+}
+
+// listFiles returns the sorted slash separated paths of the files in dir.
+func listFiles(t testing.TB, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractOptions(t *testing.T) {
+	har := newHar(t,
+		newEntry("https://example.com/index.html", "text/html", "<html></html>"),
+		newEntry("https://example.com/app.js?v=1", "application/javascript", "app()"),
+		newEntry("https://cdn.example.net/logo.svg", "image/svg+xml", "<svg/>"),
+		newEntry("https://ads.example.org/track.gif", "image/gif", "GIF89a"),
+	)
+	for _, tc := range []struct {
+		name  string
+		opts  Options
+		files []string
+		stats Stats
+	}{
+		{
+			name: "zero",
+			files: []string{
+				"ads.example.org/-track.gif",
+				"cdn.example.net/-logo.svg",
+				"example.com/-app.js",
+				"example.com/-index.html",
+			},
+			stats: Stats{Entries: 4, Written: 4},
+		},
+		{
+			name:  "allowlist",
+			opts:  Options{HostAllowlist: map[string]bool{"example.com": true}},
+			files: []string{"example.com/-app.js", "example.com/-index.html"},
+			stats: Stats{Entries: 4, Written: 2, Skipped: 2},
+		},
+		{
+			name: "allowlist and denylist",
+			opts: Options{
+				HostAllowlist: map[string]bool{"example.com": true, "ads.example.org": true},
+				HostDenylist:  map[string]bool{"ads.example.org": true},
+			},
+			files: []string{"example.com/-app.js", "example.com/-index.html"},
+			stats: Stats{Entries: 4, Written: 2, Skipped: 2},
+		},
+		{
+			name:  "mime type wildcard",
+			opts:  Options{MimeTypes: map[string]bool{"image/*": true}},
+			files: []string{"ads.example.org/-track.gif", "cdn.example.net/-logo.svg"},
+			stats: Stats{Entries: 4, Written: 2, Skipped: 2},
+		},
+		{
+			name:  "url exclude",
+			opts:  Options{URLExclude: regexp.MustCompile(`\.(gif|svg)$`)},
+			files: []string{"example.com/-app.js", "example.com/-index.html"},
+			stats: Stats{Entries: 4, Written: 2, Skipped: 2},
+		},
+		{
+			name:  "flatten",
+			opts:  Options{Flatten: true, HostAllowlist: map[string]bool{"example.com": true}},
+			files: []string{"example.com-app.js", "example.com-index.html"},
+			stats: Stats{Entries: 4, Written: 2, Skipped: 2},
+		},
+		{
+			name:  "limit",
+			opts:  Options{Limit: 1},
+			files: []string{"example.com/-index.html"},
+			// entries may be decoded before the limit is reached, so
+			// only Written is checked
+			stats: Stats{Written: 1},
+		},
+		{
+			name:  "dry run",
+			opts:  Options{DryRun: true},
+			stats: Stats{Entries: 4, Written: 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tc.opts.RootDir = dir
+			stats, err := Extract(context.Background(), bytes.NewReader(har), tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Written != tc.stats.Written {
+				t.Errorf("got %d written, want %d", stats.Written, tc.stats.Written)
+			}
+			if tc.stats.Entries != 0 && (stats.Entries != tc.stats.Entries || stats.Skipped != tc.stats.Skipped) {
+				t.Errorf("got %d entries, %d skipped, want %d, %d",
+					stats.Entries, stats.Skipped, tc.stats.Entries, tc.stats.Skipped)
+			}
+			if files := listFiles(t, dir); !reflect.DeepEqual(files, tc.files) {
+				t.Errorf("got files %q, want %q", files, tc.files)
+			}
+		})
+	}
+}
+
+func TestDedupeSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	dir := t.TempDir()
+	har := newHar(t,
+		newEntry("https://example.com/a.js", "application/javascript", "same()"),
+		newEntry("https://example.com/a.js", "application/javascript", "same()"),
+		newEntry("https://example.com/b.js", "application/javascript", "same()"),
+	)
+	stats, err := Extract(context.Background(), bytes.NewReader(har), Options{RootDir: dir, Dedupe: true, DedupeSymlink: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 2 || stats.Skipped != 1 {
+		t.Errorf("got %d written, %d skipped, want 2, 1", stats.Written, stats.Skipped)
+	}
+	// the repeated URL must not replace the file with a link to itself
+	if b, err := os.ReadFile(filepath.Join(dir, "example.com", "-a.js")); err != nil || string(b) != "same()" {
+		t.Errorf("got %q, %v reading -a.js, want %q", b, err, "same()")
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "example.com", "-b.js")); err != nil || target != "-a.js" {
+		t.Errorf("got link target %q, %v, want %q", target, err, "-a.js")
+	}
+}
+
+// failingArchive is an Archive failing the first fail writes, and recording
+// the names of the files written after.
+type failingArchive struct {
+	fail  int
+	names []string
+}
+
+func (a *failingArchive) WriteFile(name string, r io.Reader, size int64, modTime time.Time) error {
+	if a.fail > 0 {
+		a.fail--
+		return errors.New("injected failure")
+	}
+	a.names = append(a.names, name)
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func TestDedupeFailedWrite(t *testing.T) {
+	har := newHar(t,
+		newEntry("https://example.com/a.js", "application/javascript", "same()"),
+		newEntry("https://example.com/b.js", "application/javascript", "same()"),
+	)
+	archive := &failingArchive{fail: 1}
+	stats, err := Extract(context.Background(), bytes.NewReader(har), Options{Archive: archive, Dedupe: true, SkipErrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the duplicate of a body that failed to write is written instead
+	if stats.Failed != 1 || stats.Written != 1 {
+		t.Errorf("got %d failed, %d written, want 1, 1", stats.Failed, stats.Written)
+	}
+	if want := []string{"example.com/-b.js"}; !reflect.DeepEqual(archive.names, want) {
+		t.Errorf("got names %q, want %q", archive.names, want)
+	}
+}
+
+func TestOnWrittenConcurrentHars(t *testing.T) {
+	hosts := make(map[string]int)
+	x := New(Options{
+		DryRun:      true,
+		Concurrency: 4,
+		// not synchronised, as calls are serialised across HARs
+		OnWritten: func(written ManifestEntry) { hosts[written.Host]++ },
+	})
+	har := newHar(t,
+		newEntry("https://example.com/a.js", "application/javascript", "a()"),
+		newEntry("https://example.com/b.js", "application/javascript", "b()"),
+		newEntry("https://example.com/c.js", "application/javascript", "c()"),
+	)
+	const hars = 8
+	errs := make(chan error, hars)
+	for i := 0; i < hars; i++ {
+		go func() {
+			_, err := x.Extract(context.Background(), bytes.NewReader(har))
+			errs <- err
+		}()
+	}
+	for i := 0; i < hars; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := hosts["example.com"]; n != 3*hars {
+		t.Errorf("got %d entries written, want %d", n, 3*hars)
+	}
+}
+
+func TestOnCollision(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		onCollision string
+		urls        []string
+		files       []string
+		wantErr     bool
+	}{
+		{
+			name:        "same URL",
+			onCollision: CollisionError,
+			urls:        []string{"https://example.com/a.js", "https://example.com/a.js"},
+			files:       []string{"example.com/-a.js"},
+		},
+		{
+			name:        "fragment",
+			onCollision: CollisionError,
+			urls:        []string{"https://example.com/a.js", "https://example.com/a.js#top"},
+			files:       []string{"example.com/-a.js"},
+		},
+		{
+			name:        "error",
+			onCollision: CollisionError,
+			urls:        []string{"https://example.com/a.js?v=1", "https://example.com/a.js?v=2"},
+			files:       []string{"example.com/-a.js"},
+			wantErr:     true,
+		},
+		{
+			name:        "suffix",
+			onCollision: CollisionSuffix,
+			urls:        []string{"https://example.com/a.js?v=1", "https://example.com/a.js?v=2", "https://example.com/a.js?v=1#top"},
+			files:       []string{"example.com/-a-1.js", "example.com/-a.js"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var entries []Entry
+			for _, u := range tc.urls {
+				entries = append(entries, newEntry(u, "application/javascript", u))
+			}
+			dir := t.TempDir()
+			_, err := Extract(context.Background(), bytes.NewReader(newHar(t, entries...)), Options{RootDir: dir, OnCollision: tc.onCollision})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if files := listFiles(t, dir); !reflect.DeepEqual(files, tc.files) {
+				t.Errorf("got files %q, want %q", files, tc.files)
+			}
+		})
+	}
+}
+
+func TestArchiveRepeatedNames(t *testing.T) {
+	hars := [][]byte{
+		newHar(t,
+			newEntry("https://example.com/a.js", "application/javascript", "a()"),
+			newEntry("https://example.com/a.js?v=2", "application/javascript", "a(2)"),
+		),
+		newHar(t, newEntry("https://example.com/a.js", "application/javascript", "a()")),
+	}
+	for _, tc := range []struct {
+		name  string
+		new   func(w io.Writer) Archive
+		names func(t *testing.T, b []byte) []string
+	}{
+		{
+			name: "zip",
+			new:  func(w io.Writer) Archive { return NewZipArchive(w) },
+			names: func(t *testing.T, b []byte) []string {
+				r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, f := range r.File {
+					names = append(names, f.Name)
+				}
+				return names
+			},
+		},
+		{
+			name: "tar",
+			new:  func(w io.Writer) Archive { return NewTarArchive(w, 0o644) },
+			names: func(t *testing.T, b []byte) []string {
+				r := tar.NewReader(bytes.NewReader(b))
+				var names []string
+				for {
+					h, err := r.Next()
+					if err == io.EOF {
+						return names
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					names = append(names, h.Name)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			archive := tc.new(&buf)
+			x := New(Options{Archive: archive, OnCollision: CollisionOverwrite})
+			for _, har := range hars {
+				if _, err := x.Extract(context.Background(), bytes.NewReader(har)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := archive.(io.Closer).Close(); err != nil {
+				t.Fatal(err)
+			}
+			if names, want := tc.names(t, buf.Bytes()), []string{"example.com/-a.js"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("got names %q, want %q", names, want)
+			}
+		})
+	}
+}
+
+func TestLinkRedirectsAcrossHars(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	redirect := newEntry("https://example.com/old.html", "text/html", "moved")
+	redirect.Response.Status = 301
+	redirect.Response.RedirectURL = "/new.html"
+	hars := [][]byte{
+		newHar(t, redirect),
+		newHar(t, newEntry("https://example.com/new.html", "text/html", "<html></html>")),
+	}
+	dir := t.TempDir()
+	x := New(Options{RootDir: dir, LinkRedirects: true})
+	for _, har := range hars {
+		if _, err := x.Extract(context.Background(), bytes.NewReader(har)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	x.LinkRedirects()
+	if target, err := os.Readlink(filepath.Join(dir, "example.com", "-old.html")); err != nil || target != "-new.html" {
+		t.Errorf("got link target %q, %v, want %q", target, err, "-new.html")
+	}
+}
+
+func TestLinkRedirectsNormalised(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	for _, tc := range []struct{ location, target string }{
+		{"HTTPS://Example.com:443/new.html", "https://example.com/new.html"},
+		{"/n%65w.html#top", "https://example.com/new.html"},
+		{"/new.html", "https://EXAMPLE.com/n%65w.html#top"},
+	} {
+		redirect := newEntry("https://example.com/old.html", "text/html", "moved")
+		redirect.Response.Status = 301
+		redirect.Response.RedirectURL = tc.location
+		dir := t.TempDir()
+		x := New(Options{RootDir: dir, LinkRedirects: true})
+		har := newHar(t, redirect, newEntry(tc.target, "text/html", "<html></html>"))
+		if _, err := x.Extract(context.Background(), bytes.NewReader(har)); err != nil {
+			t.Fatal(err)
+		}
+		x.LinkRedirects()
+		if _, err := os.Readlink(filepath.Join(dir, "example.com", "-old.html")); err != nil {
+			t.Errorf("redirect to %s, with a target of %s: %v", tc.location, tc.target, err)
+		}
+	}
+}
+
+func TestPathEscape(t *testing.T) {
+	pathTemplate, err := ParseNameTemplate("{{.Path}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{
+		"https://example.com/../../x.txt",
+		"https://example.com/a/%2e%2e/%2e%2e/%2e%2e/x.txt",
+		"https://example.com/..%2f..%2fx.txt",
+		"https://../x.txt",
+	} {
+		for name, opts := range map[string]Options{
+			"default":     {},
+			"decode path": {DecodePath: true},
+			"flatten":     {Flatten: true},
+			"template":    {NameTemplate: pathTemplate},
+		} {
+			dir := t.TempDir()
+			opts.RootDir = filepath.Join(dir, "out")
+			_, err := Extract(context.Background(), bytes.NewReader(newHar(t, newEntry(u, "text/plain", "x"))), opts)
+			for _, file := range listFiles(t, dir) {
+				if !strings.HasPrefix(file, "out/") {
+					t.Errorf("%s with %s: wrote %s outside the output directory", u, name, file)
+				}
+			}
+			if err != nil && !strings.Contains(err.Error(), "outside the output directory") {
+				t.Errorf("%s with %s: %v", u, name, err)
+			}
+		}
+	}
+
+	// the host is a path element, so can't be cleaned away
+	_, err = Extract(context.Background(), bytes.NewReader(newHar(t, newEntry("https://../x.txt", "text/plain", "x"))), Options{RootDir: t.TempDir()})
+	if err == nil {
+		t.Error("got no error writing the entry for a host of ..")
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	want := []byte{0xfb, 0xff}
+	for _, text := range []string{
+		"+/8=", // standard
+		"+/8",  // unpadded
+		"-_8=", // URL-safe
+		"-_8",  // unpadded URL-safe
+	} {
+		if got, err := decodeBase64(text); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("decodeBase64(%q) = %x, %v, want %x", text, got, err, want)
+		}
+	}
+	if _, err := decodeBase64("+/8!"); err == nil {
+		t.Error("got no error decoding invalid base64")
+	}
+}
+
+// failingReader returns data, then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWriteFileFailure(t *testing.T) {
+	injected := errors.New("injected failure")
+	for name, write := range map[string]func(path string, r io.Reader, perm os.FileMode) error{
+		"direct": writeFile,
+		"atomic": writeFileAtomic,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "partial.txt")
+			err := write(path, &failingReader{data: []byte("partial"), err: injected}, 0o644)
+			if !errors.Is(err, injected) {
+				t.Fatalf("got error %v, want %v", err, injected)
+			}
+			// neither the partial file nor a temporary file remains
+			if files := listFiles(t, dir); len(files) != 0 {
+				t.Errorf("got files %q after a failed write", files)
+			}
+		})
+	}
+}
+
+func TestWindowsFileName(t *testing.T) {
+	tests := map[string]string{
+		"index.html":  "index.html",
+		"a<b>c:d.txt": "a_b_c_d.txt",
+		"q?x=1|2*":    "q_x=1_2_",
+		"tab\tname":   "tab_name",
+		"trailing. .": "trailing",
+		"...":         "_",
+		".":           ".",
+		"..":          "..",
+		"console.txt": "console.txt",
+		"com10":       "com10",
+		"lpt0.log":    "lpt0.log",
+	}
+	for reserved := range windowsReservedNames {
+		lower := strings.ToLower(reserved)
+		tests[reserved] = reserved + "_"
+		tests[lower+".txt"] = lower + "_.txt"
+		tests[reserved+".tar.gz"] = reserved + "_.tar.gz"
+		tests[lower+". "] = lower + "_"
+	}
+	for name, want := range tests {
+		if got := windowsFileName(name); got != want {
+			t.Errorf("windowsFileName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestShortenFileName(t *testing.T) {
+	long := strings.Repeat("a", 300) + ".html"
+	for _, tc := range []struct {
+		name    string
+		max     int
+		wantLen int
+		ext     string
+	}{
+		{name: "short.html", max: 255, wantLen: 10, ext: ".html"},
+		{name: long, max: 0, wantLen: len(long), ext: ".html"},
+		{name: long, max: 255, wantLen: 255, ext: ".html"},
+		// the cut would otherwise fall within a two byte character
+		{name: "a" + strings.Repeat("é", 150) + ".txt", max: 255, wantLen: 254, ext: ".txt"},
+		// the extension is dropped if it doesn't fit
+		{name: strings.Repeat("b", 300) + "." + strings.Repeat("x", 20), max: 20, wantLen: 20},
+	} {
+		got := shortenFileName(tc.name, tc.max)
+		if len(got) != tc.wantLen || !strings.HasSuffix(got, tc.ext) || !utf8.ValidString(got) {
+			t.Errorf("shortenFileName(%.20q..., %d) = %q (%d bytes), want %d bytes ending in %q", tc.name, tc.max, got, len(got), tc.wantLen, tc.ext)
+		}
+	}
+
+	// names sharing a long prefix remain distinct
+	a := shortenFileName(strings.Repeat("c", 300)+"1.js", 255)
+	b := shortenFileName(strings.Repeat("c", 300)+"2.js", 255)
+	if a == b {
+		t.Errorf("got %q for both names", a)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	pathTemplate, err := ParseNameTemplate("{{.Path}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url  string
+		opts Options
+		want string
+	}{
+		{url: "https://example.com/a//b/./c", opts: Options{NameTemplate: pathTemplate}, want: "a/b/c"},
+		{url: "https://example.com/a//b/./c", want: "example.com/a/b/-a-b-c"},
+		{url: "https://example.com/a//b/./", want: "example.com/a/b/index.html"},
+		{url: "https://example.com/a/../../b", want: "example.com/-b"},
+	} {
+		dir := t.TempDir()
+		tc.opts.RootDir = dir
+		if _, err := Extract(context.Background(), bytes.NewReader(newHar(t, newEntry(tc.url, "text/plain", "x"))), tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		if files := listFiles(t, dir); len(files) != 1 || files[0] != tc.want {
+			t.Errorf("%s: got files %q, want %q", tc.url, files, tc.want)
+		}
+	}
+}
+
+func TestFindEntriesSkipsEarlyValues(t *testing.T) {
+	entries := string(newHar(t, newEntry("https://example.com/a.js", "application/javascript", "a()")))
+	// the entries array of the HAR, with its closing brackets
+	entries = strings.TrimPrefix(entries, `{"log":{"entries":`)
+	for _, prefix := range []string{
+		`{"log":{"comment":"entries","entries":`,
+		`{"log":{"pages":[{"id":"entries","title":"entries"}],"entries":`,
+		`{"log":{"pages":[{"entries":"none","comment":{"entries":[]}}],"entries":`,
+		`{"comment":{"log":{"entries":"none"}},"log":{"entries":`,
+	} {
+		decoder := json.NewDecoder(strings.NewReader(prefix + entries))
+		var info logInfo
+		if err := findEntries(decoder, &info, false); err != nil {
+			t.Errorf("%s: %v", prefix, err)
+			continue
+		}
+		var entry Entry
+		if err := decoder.Decode(&entry); err != nil || entry.Request.URL != "https://example.com/a.js" {
+			t.Errorf("%s: got entry %q, %v", prefix, entry.Request.URL, err)
+		}
+	}
+}
+
+func TestNoEntries(t *testing.T) {
+	for _, har := range []string{
+		``,
+		`{}`,
+		`{"log":{}}`,
+		`{"log":{"version":"1.2","pages":[]}}`,
+		`{"other":{"entries":[]}}`,
+	} {
+		_, err := Extract(context.Background(), strings.NewReader(har), Options{DryRun: true})
+		if !errors.Is(err, ErrNoEntries) {
+			t.Errorf("%q: got error %v, want %v", har, err, ErrNoEntries)
+		}
+	}
+}
+
+func TestStreamEncoding(t *testing.T) {
+	data := []byte{0xfb, 0xef, 0xbe, 0xfb, 0xff}
+	base64Entry := func(text string) Entry {
+		e := newEntry("https://example.com/a.bin", "application/octet-stream", text)
+		e.Response.Content.Encoding = "base64"
+		return e
+	}
+	for _, tc := range []struct {
+		name string
+		text string
+		opts Options
+		want *base64.Encoding
+	}{
+		{name: "padded", text: base64.StdEncoding.EncodeToString(data), want: base64.StdEncoding},
+		{name: "unpadded", text: base64.RawStdEncoding.EncodeToString(data), want: base64.RawStdEncoding},
+		{name: "URL-safe", text: base64.URLEncoding.EncodeToString(data), want: base64.URLEncoding},
+		{name: "unpadded URL-safe", text: base64.RawURLEncoding.EncodeToString(data), want: base64.RawURLEncoding},
+		{name: "line breaks", text: "++++\r\n+/8=\n", want: base64.StdEncoding},
+		// n%4 == 1 is never valid
+		{name: "truncated", text: "+++++"},
+		// padding is only valid in a multiple of 4 characters
+		{name: "misplaced padding", text: "++++/8="},
+		{name: "dedupe", text: base64.StdEncoding.EncodeToString(data), opts: Options{Dedupe: true}},
+		{name: "dry run", text: base64.StdEncoding.EncodeToString(data), opts: Options{DryRun: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, size := streamEncoding(base64Entry(tc.text), &tc.opts)
+			if enc != tc.want {
+				t.Fatalf("got encoding %v, want %v", enc, tc.want)
+			}
+			if enc == nil {
+				return
+			}
+			decoded, err := io.ReadAll(base64.NewDecoder(enc, strings.NewReader(tc.text)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != len(decoded) || !bytes.Equal(decoded, data[:len(decoded)]) {
+				t.Errorf("got size %d, decoded %x, want %x", size, decoded, data)
+			}
+		})
+	}
+
+	if enc, _ := streamEncoding(newEntry("https://example.com/a.txt", "text/plain", "text"), &Options{}); enc != nil {
+		t.Errorf("got encoding %v for plain text", enc)
+	}
+}
+
+// BenchmarkBase64Body compares the memory allocated decoding a large base64
+// body as it is written with decoding it in full first.
+func BenchmarkBase64Body(b *testing.B) {
+	text := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xfb, 0xef, 0xbe}, 1<<20))
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc, _ := streamEncoding(Entry{Response: Response{Content: Content{Text: text, Encoding: "base64"}}}, &Options{})
+			if _, err := io.Copy(io.Discard, base64.NewDecoder(enc, strings.NewReader(text))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := decodeBase64(text)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, bytes.NewReader(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDecodeEntry compares decoding an entry with a large response text
+// as a lazyEntry, as for entries that are filtered out, with decoding it in
+// full.
+func BenchmarkDecodeEntry(b *testing.B) {
+	entry := newEntry("https://example.com/app.js", "application/javascript", strings.Repeat("say(\"hello\\n\");\n", 1<<16))
+	data, err := json.Marshal(entry)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("lazy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			var lazy lazyEntry
+			if err := json.Unmarshal(data, &lazy); err != nil {
+				b.Fatal(err)
+			}
+			_, _ = lazy.split()
+		}
+	})
+	b.Run("eager", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			var entry Entry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestLazyEntry(t *testing.T) {
+	want := newEntry("https://example.com/a.js", "application/javascript", "say(\"hi\")")
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lazy lazyEntry
+	if err := json.Unmarshal(data, &lazy); err != nil {
+		t.Fatal(err)
+	}
+	entry, text := lazy.split()
+	if entry.Response.Content.Text != "" {
+		t.Errorf("got decoded text %q", entry.Response.Content.Text)
+	}
+	if err := json.Unmarshal(text, &entry.Response.Content.Text); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("got %+v, want %+v", entry, want)
+	}
+}
+
+func TestProcessEntryReleasesText(t *testing.T) {
+	want := newEntry("https://example.com/a.js", "application/javascript", "say(\"hi\")")
+	text, err := json.Marshal(want.Response.Content.Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := want
+	entry.Response.Content.Text = ""
+	raw := rawEntry{entry: entry, text: text, index: 3}
+	written, _, err := processEntry(&raw, &Options{RootDir: t.TempDir()}, &state{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.text != nil {
+		t.Error("the raw text was retained after decoding")
+	}
+	if written == nil || written.Index != 3 {
+		t.Errorf("got %+v, want a record of index 3", written)
+	}
+}
+
+func TestDataURI(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	encoded := base64.StdEncoding.EncodeToString(png)
+	entry := newEntry("data:image/png;base64,"+encoded, "image/png", encoded)
+	entry.Response.Content.Encoding = "base64"
+	har := newHar(t, entry)
+
+	stats, err := Extract(context.Background(), bytes.NewReader(har), Options{RootDir: t.TempDir(), SkipDataURIs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SkipReasons[SkipReasonDataURI] != 1 {
+		t.Errorf("got skip reasons %v, want a %s skip", stats.SkipReasons, SkipReasonDataURI)
+	}
+
+	dir := t.TempDir()
+	if _, err := Extract(context.Background(), bytes.NewReader(har), Options{RootDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	files := listFiles(t, dir)
+	if len(files) != 1 || !regexp.MustCompile(`^_data/-[0-9a-f]{16}\.png$`).MatchString(files[0]) {
+		t.Fatalf("got files %q, want a hash named .png in _data", files)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, files[0])); err != nil || !bytes.Equal(b, png) {
+		t.Errorf("got %q, %v, want %q", b, err, png)
+	}
+}
+
+func TestHostDirIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		opts Options
+		want string
+	}{
+		{url: "http://[2001:db8::1]/", want: "2001-db8--1"},
+		{url: "http://[::1]:8080/", want: "--1"},
+		{url: "http://[::1]:8080/", opts: Options{KeepPort: true}, want: "--1_8080"},
+		{url: "http://[2001:DB8::1]/", opts: Options{LowercaseHosts: true}, want: "2001-db8--1"},
+		{url: "http://[2001:db8::1]/", opts: Options{RegisteredDomain: true}, want: "2001-db8--1"},
+		{url: "http://192.0.2.1:8080/", opts: Options{KeepPort: true, RegisteredDomain: true}, want: "192.0.2.1_8080"},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hostDir(u, &tc.opts); got != tc.want {
+			t.Errorf("hostDir(%s) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestFragment(t *testing.T) {
+	pathTemplate, err := ParseNameTemplate("{{.Host}}/{{.Path}}-{{.Query}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	har := newHar(t,
+		newEntry("https://example.com/a.js?v=1#frag", "application/javascript", "a()"),
+		newEntry("https://example.com/a.js?v=1#other%2Fpath", "application/javascript", "a()"),
+		newEntry("https://example.com/dir/#frag", "text/html", "<html></html>"),
+	)
+	for name, opts := range map[string]Options{
+		"default":    {},
+		"template":   {NameTemplate: pathTemplate},
+		"flatten":    {Flatten: true},
+		"query hash": {QueryHash: true},
+		"decode":     {DecodePath: true},
+		// entries differing only by fragment are the same URL, so don't
+		// collide
+		"error":  {OnCollision: CollisionError},
+		"suffix": {OnCollision: CollisionSuffix},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts.RootDir = dir
+			if _, err := Extract(context.Background(), bytes.NewReader(har), opts); err != nil {
+				t.Fatal(err)
+			}
+			files := listFiles(t, dir)
+			for _, file := range files {
+				if strings.Contains(file, "frag") || strings.Contains(file, "other") {
+					t.Errorf("fragment found in %s", file)
+				}
+			}
+			if len(files) != 2 {
+				t.Errorf("got files %q, want 2", files)
+			}
+		})
+	}
+}
+
+func TestConcurrentSamePath(t *testing.T) {
+	long := strings.Repeat("A", 256<<10)
+	short := strings.Repeat("B", 1<<10)
+	var entries []Entry
+	for i := 0; i < 50; i++ {
+		u := fmt.Sprintf("https://example.com/%d.txt", i)
+		entries = append(entries, newEntry(u, "text/plain", long), newEntry(u, "text/plain", short))
+	}
+	dir := t.TempDir()
+	opts := Options{RootDir: dir, Concurrency: 8, OnCollision: CollisionOverwrite}
+	if _, err := Extract(context.Background(), bytes.NewReader(newHar(t, entries...)), opts); err != nil {
+		t.Fatal(err)
+	}
+	files := listFiles(t, dir)
+	if len(files) != 50 {
+		t.Fatalf("got %d files, want 50", len(files))
+	}
+	// either entry may be written last, but only whole
+	for _, file := range files {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != long && s != short {
+			t.Errorf("%s: got a mix of the bodies, of %d bytes", file, len(b))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package harextract
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Level is the severity of an Event.
+type Level string
+
+// Levels of logged events.
+const (
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+	LevelError Level = "error"
+)
+
+// Field is a key value pair attached to an Event.
+type Field struct {
+	Key   string
+	Value any
+}
+
+func field(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Event is a message logged during extraction.
+type Event struct {
+	Level  Level
+	Msg    string
+	Fields []Field
+	// Text is the human readable form of the event.
+	Text string
+}
+
+// NewEvent returns an Event for msg at level, with a Text consisting of msg
+// followed by the value of each field, separated by ": ". Warnings are
+// prefixed with "Warning: ".
+func NewEvent(level Level, msg string, fields ...Field) Event {
+	var text bytes.Buffer
+	if level == LevelWarn {
+		text.WriteString("Warning: ")
+	}
+	text.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&text, ": %v", f.Value)
+	}
+	return Event{Level: level, Msg: msg, Fields: fields, Text: text.String()}
+}
+
+// Logger receives the events logged during extraction. It must be safe for
+// concurrent use.
+type Logger interface {
+	Log(event Event)
+}
+
+// log sends NewEvent(level, msg, fields...) to the Logger, if any.
+func (o *Options) log(level Level, msg string, fields ...Field) {
+	o.event(NewEvent(level, msg, fields...))
+}
+
+// event sends e to the Logger, if any.
+func (o *Options) event(e Event) {
+	if o.Logger != nil {
+		o.Logger.Log(e)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/joeycumines/har-extractor/harextract"
+)
+
+// Levels of logged messages.
+const (
+	levelInfo  = harextract.LevelInfo
+	levelWarn  = harextract.LevelWarn
+	levelError = harextract.LevelError
+)
+
+func field(key string, value any) harextract.Field {
+	return harextract.Field{Key: key, Value: value}
+}
+
+// logger writes informational messages, either as human readable lines, or
+// as single-line JSON objects. It is safe for concurrent use, and implements
+// harextract.Logger.
+type logger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+	// quiet discards messages below levelWarn
+	quiet bool
+}
+
+// log writes msg at level, in the form given by harextract.NewEvent.
+func (l *logger) log(level harextract.Level, msg string, fields ...harextract.Field) {
+	l.Log(harextract.NewEvent(level, msg, fields...))
+}
+
+// event writes a message at level, where the human readable form is text,
+// and the JSON form consists of msg and fields.
+func (l *logger) event(level harextract.Level, msg, text string, fields ...harextract.Field) {
+	l.Log(harextract.Event{Level: level, Msg: msg, Fields: fields, Text: text})
+}
+
+func (l *logger) Log(e harextract.Event) {
+	if l.quiet && e.Level == levelInfo {
+		return
+	}
+
+	var b bytes.Buffer
+	if l.json {
+		b.WriteString(`{"level":`)
+		writeJSONValue(&b, e.Level)
+		b.WriteString(`,"msg":`)
+		writeJSONValue(&b, e.Msg)
+		for _, f := range e.Fields {
+			b.WriteByte(',')
+			writeJSONValue(&b, f.Key)
+			b.WriteByte(':')
+			writeJSONValue(&b, f.Value)
+		}
+		b.WriteByte('}')
+	} else {
+		b.WriteString(e.Text)
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(b.Bytes())
+}
+
+func writeJSONValue(b *bytes.Buffer, value any) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(data)
+}
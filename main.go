@@ -1,220 +1,1373 @@
 /*
 Command har-extractor provides a streaming HAR file parser, which can extract
-and write response content to disk. It preserves directory structure.
+and write response content to disk. It preserves directory structure. Gzip
+compressed HAR files are detected and decompressed automatically. The
+extraction is implemented by package
+github.com/joeycumines/har-extractor/harextract, which may be used as a
+library.
 
 Usage:
 
-	$ har-extractor -o /path/to/output <harfiles...>
+	$ har-extractor [extract] -o /path/to/output <harfiles...>
+	$ har-extractor list [options] <harfiles...>
+	$ har-extractor stats [options] <harfiles...>
+
+The list subcommand prints a table of the entries that would be extracted
+with the given options, and the stats subcommand summarises them, by status
+class, MIME type and host, without writing anything.
+
+A harfile of "-" reads the HAR from stdin, and an http or https URL fetches
+it from the server. Directories may be given with the -recursive flag, to
+process every .har and .har.gz file within them. Zip archives (e.g. as
+exported by Firefox) are opened, to process the HAR files they contain.
+Wildcards (e.g. *.har) are expanded, for shells that don't.
+
+Options may also be given in a file, with the -config flag, as either a JSON
+object or lines of key=value pairs, keyed by flag name (without the leading
+dash). Flags given on the command line take precedence.
+
+	{"output": "out", "allowed-hosts": ["example.com", "example.org"], "verbose": true}
+
+Log messages are written to stderr, leaving stdout for data output, such as
+that of -dry-run-json.
+
+The exit status is 1 if any HAR file, or with -skip-errors any entry, failed
+to process.
+
+An interrupt (e.g. Ctrl-C) stops processing once the entries in progress are
+written, then writes the manifest and summary as usual, and exits with status
+130. A second interrupt exits immediately.
 
 Options:
 
+	-add-extension
+	      Append a file extension derived from the MIME type, for paths without one
+	-after string
+	      Only extract entries started at or after this RFC3339 time (entries without a valid time are kept)
 	-allowed-hosts string
 	      Comma-separated list of hosts to allow (e.g. "example.com,example.org")
+	-atomic
+	      Write each file via a temporary file, renamed into place once complete
+	-before string
+	      Only extract entries started before this RFC3339 time (entries without a valid time are kept)
+	-buffer-size size
+	      Read HAR files through a buffer of this size (e.g. 1MB), rather than 4KB
+	-by-page
+	      Nest output under a directory named for the title (or id) of each entry's page, or "_nopage"
+	-concurrency int
+	      Number of entries to process concurrently (default 1)
+	-config file
+	      Read options from a JSON or key=value file, keyed by flag name, which command line flags override
+	-creator string
+	      Only process HAR files created by a tool whose name contains this text, ignoring case (e.g. "firefox")
+	-decode-content-encoding
+	      Decompress response bodies according to their Content-Encoding header
+	-decode-path
+	      Decode the URL path one segment at a time, so encoded slashes don't create directories
+	-dedupe
+	      Skip response bodies identical to one already written
+	-dedupe-suffix
+	      Suffix a content hash to colliding output paths, skipping identical content
+	-dedupe-symlink
+	      With -dedupe, symlink duplicate bodies to the first copy instead of skipping them
+	-dir-mode mode
+	      Permissions of created directories, as an octal mode (default 0755)
+	-dir-per-status string
+	      Nest files under a directory for their response status within the host directory, either "class" (e.g. 4xx) or "exact" (e.g. 404)
+	-dirs-only
+	      Create the output directories, without writing any files (implies -dry-run)
 	-dry-run
 	      Enable dry run mode
+	-dry-run-json
+	      Print the files a dry run would write as JSON (implies -dry-run)
+	-errors-dir subdir
+	      Write entries with an error status (400 or above) under this subdir of the output directory, rather than alongside other entries
+	-exclude-extensions string
+	      Comma-separated list of file extensions to skip (e.g. "map")
+	-exclude-hosts string
+	      Comma-separated list of hosts to skip (e.g. "google-analytics.com")
+	-extract-requests
+	      Also write request post data, to a sibling file with a .request suffix
+	-extract-websockets
+	      Also write WebSocket frames, to numbered files in a sibling directory with a .ws suffix
+	-file-concurrency int
+	      Number of HAR files to process concurrently (default 1)
+	-file-mode mode
+	      Permissions of created files, as an octal mode (default 0644)
+	-flatten
+	      Write all files directly to the output directory, ignoring URL directory structure
+	-gen-index
+	      Write an index.html to the output directory, linking to each extracted file
+	-include-extensions string
+	      Comma-separated list of file extensions to extract (e.g. "js,css")
+	-index int
+	      Only extract the entry at this position (from 0) within the entries of each HAR file (default -1)
+	-index-name string
+	      File name used for URLs with a directory style path (default "index.html")
+	-keep-port
+	      Include the port in host directory names, e.g. "localhost_3000"
+	-limit int
+	      Stop after writing this many entries across all HAR files (0 for no limit)
+	-link-redirects
+	      Replace the files written for redirect responses with symlinks to the files written for their targets
+	-log-json
+	      Write log messages to stderr as JSON, one object per line
+	-lowercase-hosts
+	      Lowercase host directory names
+	-manifest string
+	      Write a JSON manifest of extracted files to this path
+	-max-filename-len int
+	      Truncate file and directory names longer than this many bytes, appending a hash of the original (0 for no limit) (default 255)
+	-max-size size
+	      Skip response bodies larger than size (e.g. 500KB, 10MB)
+	-methods string
+	      Comma-separated list of request methods to extract (e.g. "GET,POST")
+	-mime-types string
+	      Comma-separated list of response MIME types to extract (e.g. "image/*,application/javascript")
+	-min-size size
+	      Skip decoded response bodies smaller than size (e.g. 100B, 1KB)
+	-name-template template
+	      Go template for the output path, with fields Scheme, Host, Path, Dir, Name, Base, Ext, Query, Status and Method (default "{{.Host}}/{{.Dir}}/{{.Name}}")
+	-ndjson
+	      Print a JSON object to stdout for each file written, as it is written, one per line
+	-no-clobber
+	      Skip entries whose output file already exists
+	-no-write
+	      Write only the -manifest, of the files that would be extracted (implies -dry-run)
 	-o string
 	      Output directory (short) (default ".")
+	-on-collision string
+	      How to handle different URLs with the same output path: "warn" (overwrite with a warning), "error", "suffix" (append -1, -2, etc.) or "overwrite" (default "warn")
 	-output string
 	      Output directory (default ".")
+	-path-prefix subdir
+	      Write all entries under this subdir of the output directory, which is included in manifest paths
+	-preserve-time
+	      Set the modification time of extracted files to the entry's startedDateTime
+	-progress
+	      Periodically report progress to stderr
+	-query-as-dir
+	      Write entries with a query string to an index file within a directory named for the query, e.g. "file/a=1_b=2/index.html"
+	-query-hash
+	      Append a short hash of the query string, if any, to file names, e.g. "search-a1b2c3d4"
+	-query-param name[=value]
+	      Only extract entries whose request URL has this query parameter, given as name[=value] (may be repeated)
+	-quiet
+	      Only log warnings and errors
 	-r    Remove query string from file path (short)
+	-recursive
+	      Process all .har and .har.gz files within directory arguments
+	-registered-domain
+	      Group hosts by their registered domain, e.g. "example.com" for "a.example.com"
 	-remove-query-string
 	      Remove query string from file path
+	-resource-types string
+	      Comma-separated list of Chrome _resourceType values to extract (e.g. "document,script")
+	-save-headers
+	      Also write response headers, to a sibling file with a .headers suffix
+	-scheme-prefix
+	      Nest host directories under a directory for the URL scheme, e.g. "https/example.com"
+	-skip-data-uris
+	      Skip entries for data: URIs, rather than writing them to a "_data" directory (default true)
+	-skip-empty
+	      Skip entries with no response content, rather than writing empty files
+	-skip-errors
+	      Log and skip entries that fail to process, rather than abandoning the HAR file
+	-skip-redirects
+	      Skip redirect (3xx) responses, even if matched by -status
+	-skip-unprefixed
+	      With -strip-path-prefix, skip entries whose URL path doesn't begin with the prefix
+	-slugify
+	      Make output file and directory names ASCII, removing accents, transliterating Cyrillic, and replacing other characters with "_"
+	-status string
+	      Comma-separated list of response status codes or ranges to extract (e.g. "200,301,400-499")
+	-stdout
+	      With -index, write the decoded response body of the entry to stdout, rather than the output directory
+	-strict
+	      Reject HAR files that aren't structured as expected, and skip entries with an unsupported content encoding
+	-strip-path-prefix string
+	      Remove this prefix from URL paths, e.g. "/static/assets"
+	-subdomain-dirs
+	      With -registered-domain, nest each host directory within that of its registered domain
+	-tar path
+	      Write extracted files to a tar archive at this path ("-" for stdout), rather than the output directory
+	-tar.gz path
+	      Write extracted files to a gzip compressed tar archive at this path ("-" for stdout), rather than the output directory
+	-timeout duration
+	      Timeout for fetching each HAR given as an http or https URL (0 for none)
+	-unicode-hosts
+	      Decode internationalized (punycode) host names in directory names, e.g. "münchen.de"
+	-url-exclude string
+	      Regular expression the request URL must not match
+	-url-include string
+	      Regular expression the request URL must match
 	-verbose
 	      Show processing file path
+	-verify-size
+	      Warn about bodies whose length differs from the recorded content size by more than 1%
+	-version
+	      Print the version and exit
+	-write-retries int
+	      Number of times to retry writing a file after a transient error (e.g. EAGAIN or EBUSY)
+	-zip path
+	      Write extracted files to a zip archive at this path, rather than the output directory
 */
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/joeycumines/har-extractor/harextract"
 )
 
-type Content struct {
-	Size        int    `json:"size"`
-	MimeType    string `json:"mimeType"`
-	Text        string `json:"text"`
-	Compression int    `json:"compression"`
-	Encoding    string `json:"encoding"`
+// byteSize is a flag.Value holding a number of bytes, which may be given with
+// a unit suffix of KB, MB or GB (in powers of 1024), e.g. "500KB".
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
 }
 
-type Response struct {
-	Status  int     `json:"status"`
-	Content Content `json:"content"`
+func (b *byteSize) Set(s string) error {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * float64(multiplier))
+	return nil
 }
 
-type Request struct {
-	Method string `json:"method"`
-	URL    string `json:"url"`
+// fileMode is a flag.Value holding file permissions, given in octal, e.g.
+// "0644".
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m))
 }
 
-type Entry struct {
-	Request  Request  `json:"request"`
-	Response Response `json:"response"`
+func (m *fileMode) Set(s string) error {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil || os.FileMode(n)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid permissions %q", s)
+	}
+	*m = fileMode(n)
+	return nil
 }
 
-func safeFileName(s string) string {
-	return strings.Map(func(r rune) rune {
-		if r == '/' || r == '\\' {
-			return '-'
+// queryParams is a flag.Value accumulating the query parameters given by each
+// use of the flag, as "name" or "name=value".
+type queryParams []harextract.QueryParam
+
+func (q *queryParams) String() string {
+	var items []string
+	for _, param := range *q {
+		if param.HasValue {
+			items = append(items, param.Name+"="+param.Value)
+		} else {
+			items = append(items, param.Name)
 		}
-		return r
-	}, s)
+	}
+	return strings.Join(items, ",")
 }
 
-func processHar(reader io.Reader, rootDir string, removeQueryString bool, dryRun bool, verbose bool, hostAllowlist map[string]bool) (int, error) {
-	var count int
-	decoder := json.NewDecoder(reader)
+func (q *queryParams) Set(s string) error {
+	name, value, hasValue := strings.Cut(s, "=")
+	if name == "" {
+		return fmt.Errorf("invalid query parameter %q", s)
+	}
+	*q = append(*q, harextract.QueryParam{Name: name, Value: value, HasValue: hasValue})
+	return nil
+}
 
-	// Read until the "entries" key
-	for {
-		token, err := decoder.Token()
+// parseStatusRanges parses a comma-separated list of status codes and ranges,
+// e.g. "200,301,400-499".
+func parseStatusRanges(s string) ([]harextract.StatusRange, error) {
+	var ranges []harextract.StatusRange
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		minStr, maxStr, isRange := strings.Cut(item, "-")
+		if !isRange {
+			maxStr = minStr
+		}
+		lo, err := strconv.Atoi(strings.TrimSpace(minStr))
 		if err != nil {
-			return count, err
+			return nil, fmt.Errorf("invalid status %q", item)
+		}
+		hi, err := strconv.Atoi(strings.TrimSpace(maxStr))
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid status range %q", item)
 		}
+		ranges = append(ranges, harextract.StatusRange{Min: lo, Max: hi})
+	}
+	return ranges, nil
+}
 
-		if key, ok := token.(string); ok && key == "entries" {
-			// Break the loop if the key is "entries"
-			break
+// findHarFiles returns the paths of all .har and .har.gz files within dir.
+func findHarFiles(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name := strings.ToLower(d.Name()); !d.IsDir() && (strings.HasSuffix(name, ".har") || strings.HasSuffix(name, ".har.gz")) {
+			paths = append(paths, path)
 		}
+		return nil
+	})
+	return paths, err
+}
+
+// sizedReader is an io.Reader of a known size, which harextract uses to
+// estimate the remaining time for -progress.
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+func (r sizedReader) Size() int64 {
+	return r.size
+}
+
+// fetchHar extracts the HAR served at the given http or https URL. Responses
+// with a non-2xx status are treated as errors.
+func fetchHar(ctx context.Context, client *http.Client, rawURL string, x *harextract.Extractor) (harextract.Stats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return harextract.Stats{}, err
 	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return harextract.Stats{}, err
+	}
+	defer resp.Body.Close()
 
-	// Expect the next token to be the opening bracket [
-	if _, err := decoder.Token(); err != nil {
-		return count, err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return harextract.Stats{}, fmt.Errorf("unexpected response status: %s", resp.Status)
 	}
 
-	for decoder.More() {
-		var entry Entry
-		if err := decoder.Decode(&entry); err != nil {
-			return count, err
-		}
+	if resp.ContentLength > 0 {
+		return x.Extract(ctx, sizedReader{Reader: resp.Body, size: resp.ContentLength})
+	}
+	return x.Extract(ctx, resp.Body)
+}
 
-		if err := processEntry(entry, rootDir, removeQueryString, dryRun, verbose, hostAllowlist); err != nil {
-			return count, err
+// openZipHars opens the zip archive at path, returning its .har and .har.gz
+// files, which remain readable until the process exits.
+func openZipHars(path string) ([]*zip.File, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	var members []*zip.File
+	for _, f := range r.File {
+		if name := strings.ToLower(f.Name); !f.FileInfo().IsDir() && (strings.HasSuffix(name, ".har") || strings.HasSuffix(name, ".har.gz")) {
+			members = append(members, f)
 		}
-
-		count++
 	}
+	if len(members) == 0 {
+		_ = r.Close()
+		return nil, errors.New("no .har or .har.gz files found")
+	}
+	return members, nil
+}
 
-	// Expect the next token to be the closing bracket ]
-	if _, err := decoder.Token(); err != nil {
-		return count, err
+// extractZipMember extracts the HAR file f, within a zip archive.
+func extractZipMember(ctx context.Context, f *zip.File, x *harextract.Extractor) (harextract.Stats, error) {
+	r, err := f.Open()
+	if err != nil {
+		return harextract.Stats{}, err
 	}
+	defer r.Close()
+	return x.Extract(ctx, sizedReader{Reader: r, size: int64(f.UncompressedSize64)})
+}
 
-	return count, nil
+// isHarURL reports whether the harfile argument s is an http or https URL.
+func isHarURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
 }
 
-func processEntry(entry Entry, rootDir string, removeQueryString bool, dryRun bool, verbose bool, hostAllowlist map[string]bool) error {
-	parsedUrl, err := url.Parse(entry.Request.URL)
+// loadConfig sets flags from the config file at path, unless they were given
+// on the command line. The file is either a JSON object, or lines of
+// key=value pairs, where blank lines and those starting with "#" are ignored.
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
+	values, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// aliases, such as -o and -output, share a Value
+	explicit := make(map[flag.Value]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Value] = true
+	})
 
-	if len(hostAllowlist) > 0 {
-		if !hostAllowlist[parsedUrl.Host] {
-			return nil
+	for _, kv := range values {
+		f := flag.Lookup(kv[0])
+		if f == nil || f.Name == "config" {
+			return fmt.Errorf("%s: unknown option %q", path, kv[0])
+		}
+		if explicit[f.Value] {
+			continue
+		}
+		if err := f.Value.Set(kv[1]); err != nil {
+			return fmt.Errorf("%s: invalid %s value %q: %w", path, kv[0], kv[1], err)
 		}
 	}
+	return nil
+}
 
-	if removeQueryString {
-		parsedUrl.RawQuery = ""
+// parseConfig parses the content of a config file into key value pairs. JSON
+// values may be strings, numbers, booleans, or arrays of strings, which are
+// joined with commas.
+func parseConfig(data []byte) ([][2]string, error) {
+	var values [][2]string
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &object); err != nil {
+			return nil, err
+		}
+		for key, raw := range object {
+			var value string
+			var list []string
+			switch raw[0] {
+			case '"':
+				if err := json.Unmarshal(raw, &value); err != nil {
+					return nil, err
+				}
+			case '[':
+				if err := json.Unmarshal(raw, &list); err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+				value = strings.Join(list, ",")
+			case '{', 'n':
+				return nil, fmt.Errorf("%s: must be a string, number, boolean or array of strings", key)
+			default:
+				value = string(raw)
+			}
+			values = append(values, [2]string{key, value})
+		}
+		// for consistent errors
+		sort.Slice(values, func(i, j int) bool { return values[i][0] < values[j][0] })
+		return values, nil
 	}
 
-	dirPath := filepath.Join(rootDir, parsedUrl.Host, filepath.Dir(parsedUrl.Path))
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key=value", i+1)
+		}
+		values = append(values, [2]string{strings.TrimSpace(key), strings.TrimSpace(value)})
+	}
+	return values, nil
+}
 
-	if !dryRun {
-		err = os.MkdirAll(dirPath, os.ModePerm)
-		if err != nil {
-			return err
+// parseList parses a comma-separated list into a set, ignoring empty items.
+func parseList(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
 		}
 	}
+	return set
+}
 
-	filePath := filepath.Join(dirPath, safeFileName(parsedUrl.Path))
-	if verbose {
-		fmt.Println("Processing: ", filePath)
+// parseExtensions parses a comma-separated list of file extensions into a set
+// of lowercase extensions, each with a leading dot.
+func parseExtensions(s string) map[string]bool {
+	set := make(map[string]bool)
+	for item := range parseList(strings.ToLower(s)) {
+		set["."+strings.TrimPrefix(item, ".")] = true
 	}
+	return set
+}
 
-	if dryRun {
-		return nil
+// statsFields returns the counts of s, for logging.
+func statsFields(s harextract.Stats) []harextract.Field {
+	return []harextract.Field{
+		field("entries", s.Entries),
+		field("written", s.Written),
+		field("skipped", s.Skipped),
+		field("failed", s.Failed),
+		field("bytes", s.Bytes),
 	}
+}
+
+// printCounts writes a table of counts, such as the number of entries written
+// per host, in descending order.
+func printCounts(w io.Writer, counts map[string]int) {
+	hosts := make([]string, 0, len(counts))
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if counts[hosts[i]] != counts[hosts[j]] {
+			return counts[hosts[i]] > counts[hosts[j]]
+		}
+		return hosts[i] < hosts[j]
+	})
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%8d  %s\n", counts[host], host)
+	}
+}
+
+// reasonCounts converts the number of entries skipped per reason, for
+// printCounts.
+func reasonCounts(reasons map[harextract.SkipReason]int) map[string]int {
+	counts := make(map[string]int, len(reasons))
+	for reason, count := range reasons {
+		counts[string(reason)] = count
+	}
+	return counts
+}
+
+// plannedWrite describes a file that would have been written, as output by
+// the -dry-run-json flag.
+type plannedWrite struct {
+	URL      string `json:"url"`
+	Path     string `json:"path"`
+	Bytes    int    `json:"bytes"`
+	MimeType string `json:"mimeType"`
+}
+
+// writtenEntry describes a file written, as output by the -ndjson flag.
+type writtenEntry struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Bytes  int    `json:"bytes"`
+}
 
-	file, err := os.Create(filePath)
+// printPlannedWrites prints the files that would have been written for
+// entries, as a JSON array.
+func printPlannedWrites(w io.Writer, rootDir string, entries []harextract.ManifestEntry) error {
+	planned := make([]plannedWrite, 0, len(entries))
+	for _, entry := range entries {
+		planned = append(planned, plannedWrite{
+			URL:      entry.URL,
+			Path:     filepath.Join(rootDir, filepath.FromSlash(entry.OutputPath)),
+			Bytes:    entry.Bytes,
+			MimeType: entry.MimeType,
+		})
+	}
+	data, err := json.MarshalIndent(planned, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// errIndexDone stops reading a HAR once the entry selected by -index has been
+// seen.
+var errIndexDone = errors.New("entry found")
+
+// withoutIndexDone returns err without errIndexDone, which may be joined with
+// the errors of entries processed before the HAR was left unread.
+func withoutIndexDone(err error) error {
+	if err == errIndexDone {
+		return nil
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return err
+	}
+	var errs []error
+	for _, err := range joined.Unwrap() {
+		if err != errIndexDone {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	// handle base64 encoding
-	if entry.Response.Content.Encoding == "base64" {
-		var data []byte
-		data, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text)
+// createArchive creates an archive of the given format ("zip", "tar" or
+// "tar.gz") at path, where "-" is stdout. The returned function completes the
+// archive, and closes the file. In dry run mode, nothing is written.
+func createArchive(format, path string, perm os.FileMode, dryRun bool) (harextract.Archive, func() error, error) {
+	var w io.Writer = io.Discard
+	var closers []io.Closer
+	if !dryRun && path == "-" {
+		w = os.Stdout
+	} else if !dryRun {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		_, err = file.Write(data)
-	} else {
-		_, err = file.WriteString(entry.Response.Content.Text)
+		w = file
+		closers = append(closers, file)
 	}
 
-	if err == nil {
-		err = file.Close()
+	var archive interface {
+		harextract.Archive
+		io.Closer
+	}
+	switch format {
+	case "zip":
+		archive = harextract.NewZipArchive(w)
+	case "tar":
+		archive = harextract.NewTarArchive(w, perm)
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		closers = append([]io.Closer{gz}, closers...)
+		archive = harextract.NewTarArchive(gz, perm)
 	}
+	closers = append([]io.Closer{archive}, closers...)
 
-	return err
+	return archive, func() error {
+		var errs []error
+		for _, c := range closers {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+// entryRowFormat is the format of each row of the table printed by the list
+// subcommand. Rows are printed as the entries are processed, so the columns
+// have fixed widths, rather than fitting the widest value.
+const entryRowFormat = "%-5v  %-7v  %-6v  %-24v  %-10v  %v\n"
+
+// printEntriesHeader prints the header of the table printed by the list
+// subcommand.
+func printEntriesHeader(w io.Writer) {
+	fmt.Fprintf(w, entryRowFormat, "INDEX", "METHOD", "STATUS", "MIME", "SIZE", "URL")
+}
+
+// printEntry prints the row of entry, in the table printed by the list
+// subcommand.
+func printEntry(w io.Writer, entry harextract.ManifestEntry) {
+	fmt.Fprintf(w, entryRowFormat, entry.Index, entry.Method, entry.Status, entry.MimeType, entry.Bytes, entry.URL)
+}
+
+// writeManifest writes entries to path as a JSON array, creating it with the
+// permissions perm.
+func writeManifest(path string, entries []harextract.ManifestEntry, perm os.FileMode) error {
+	if entries == nil {
+		entries = []harextract.ManifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), perm)
+}
+
+// writeIndex writes an index.html to rootDir, linking to the output path of
+// each of entries, grouped by host. It's created with the permissions perm.
+func writeIndex(rootDir string, entries []harextract.ManifestEntry, perm os.FileMode) error {
+	hostPaths := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if !seen[entry.OutputPath] {
+			seen[entry.OutputPath] = true
+			hostPaths[entry.Host] = append(hostPaths[entry.Host], entry.OutputPath)
+		}
+	}
+	hosts := make([]string, 0, len(hostPaths))
+	for host := range hostPaths {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var b bytes.Buffer
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Index</title>\n</head>\n<body>\n")
+	for _, host := range hosts {
+		paths := hostPaths[host]
+		sort.Strings(paths)
+		fmt.Fprintf(&b, "<h2>%s</h2>\n<ul>\n", html.EscapeString(host))
+		for _, p := range paths {
+			href := (&url.URL{Path: p}).String()
+			fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(p))
+		}
+		b.WriteString("</ul>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+
+	return os.WriteFile(filepath.Join(rootDir, "index.html"), b.Bytes(), perm)
 }
 
 func main() {
-	var output string
-	var removeQueryString bool
-	var dryRun bool
-	var verbose bool
+	var opts harextract.Options
+	var log *logger
+	var dryRunJSON bool
+	var noWrite bool
+	var maxSize byteSize
+	var minSize byteSize
+	var bufferSize byteSize
+	var fileConcurrency int
+	dirPerm := fileMode(0755)
+	filePerm := fileMode(0644)
 	var hostAllowlistStr string
+	var hostDenylistStr string
+	var mimeTypesStr string
+	var includeExtensionsStr string
+	var excludeExtensionsStr string
+	var statusesStr string
+	var methodsStr string
+	var resourceTypesStr string
+	var urlIncludeStr string
+	var urlExcludeStr string
+	var afterStr string
+	var beforeStr string
+	var manifestPath string
+	var zipPath string
+	var tarPath string
+	var tarGzPath string
+	var nameTemplateStr string
+	var recursive bool
+	var configPath string
+	var printVersion bool
+	var entryIndex int
+	var ndjson bool
+	var toStdout bool
+	var genIndex bool
+	var logJSON bool
+	var quiet bool
+	var timeout time.Duration
 
-	flag.StringVar(&output, "output", ".", "Output directory")
-	flag.StringVar(&output, "o", ".", "Output directory (short)")
-	flag.BoolVar(&removeQueryString, "remove-query-string", false, "Remove query string from file path")
-	flag.BoolVar(&removeQueryString, "r", false, "Remove query string from file path (short)")
-	flag.BoolVar(&dryRun, "dry-run", false, "Enable dry run mode")
-	flag.BoolVar(&verbose, "verbose", false, "Show processing file path")
+	flag.BoolVar(&printVersion, "version", false, "Print the version and exit")
+	flag.StringVar(&configPath, "config", "", "Read options from a JSON or key=value `file`, keyed by flag name, which command line flags override")
+	flag.StringVar(&opts.RootDir, "output", ".", "Output directory")
+	flag.StringVar(&opts.RootDir, "o", ".", "Output directory (short)")
+	flag.BoolVar(&opts.RemoveQueryString, "remove-query-string", false, "Remove query string from file path")
+	flag.BoolVar(&opts.RemoveQueryString, "r", false, "Remove query string from file path (short)")
+	flag.BoolVar(&opts.QueryHash, "query-hash", false, "Append a short hash of the query string, if any, to file names, e.g. \"search-a1b2c3d4\"")
+	flag.BoolVar(&opts.QueryAsDir, "query-as-dir", false, "Write entries with a query string to an index file within a directory named for the query, e.g. \"file/a=1_b=2/index.html\"")
+	flag.BoolVar(&opts.DryRun, "dry-run", false, "Enable dry run mode")
+	flag.StringVar(&opts.StripPathPrefix, "strip-path-prefix", "", "Remove this prefix from URL paths, e.g. \"/static/assets\"")
+	flag.BoolVar(&opts.SkipUnprefixed, "skip-unprefixed", false, "With -strip-path-prefix, skip entries whose URL path doesn't begin with the prefix")
+	flag.BoolVar(&opts.DirsOnly, "dirs-only", false, "Create the output directories, without writing any files (implies -dry-run)")
+	flag.BoolVar(&ndjson, "ndjson", false, "Print a JSON object to stdout for each file written, as it is written, one per line")
+	flag.BoolVar(&dryRunJSON, "dry-run-json", false, "Print the files a dry run would write as JSON (implies -dry-run)")
+	flag.BoolVar(&opts.Verbose, "verbose", false, "Show processing file path")
+	flag.BoolVar(&logJSON, "log-json", false, "Write log messages to stderr as JSON, one object per line")
+	flag.BoolVar(&quiet, "quiet", false, "Only log warnings and errors")
+	flag.DurationVar(&timeout, "timeout", 0, "Timeout for fetching each HAR given as an http or https URL (0 for none)")
+	flag.StringVar(&zipPath, "zip", "", "Write extracted files to a zip archive at this `path`, rather than the output directory")
+	flag.StringVar(&tarPath, "tar", "", "Write extracted files to a tar archive at this `path` (\"-\" for stdout), rather than the output directory")
+	flag.StringVar(&tarGzPath, "tar.gz", "", "Write extracted files to a gzip compressed tar archive at this `path` (\"-\" for stdout), rather than the output directory")
+	flag.StringVar(&manifestPath, "manifest", "", "Write a JSON manifest of extracted files to this path")
+	flag.BoolVar(&noWrite, "no-write", false, "Write only the -manifest, of the files that would be extracted (implies -dry-run)")
+	flag.BoolVar(&genIndex, "gen-index", false, "Write an index.html to the output directory, linking to each extracted file")
+	flag.IntVar(&opts.Concurrency, "concurrency", 1, "Number of entries to process concurrently")
+	flag.IntVar(&fileConcurrency, "file-concurrency", 1, "Number of HAR files to process concurrently")
+	flag.StringVar(&nameTemplateStr, "name-template", harextract.DefaultNameTemplate, "Go `template` for the output path, with fields Scheme, Host, Path, Dir, Name, Base, Ext, Query, Status and Method")
+	flag.BoolVar(&opts.DecodePath, "decode-path", false, "Decode the URL path one segment at a time, so encoded slashes don't create directories")
+	flag.BoolVar(&opts.ByPage, "by-page", false, "Nest output under a directory named for the title (or id) of each entry's page, or \"_nopage\"")
+	flag.BoolVar(&opts.SchemePrefix, "scheme-prefix", false, "Nest host directories under a directory for the URL scheme, e.g. \"https/example.com\"")
+	flag.StringVar(&opts.StatusDir, "dir-per-status", "", "Nest files under a directory for their response status within the host directory, either \"class\" (e.g. 4xx) or \"exact\" (e.g. 404)")
+	flag.BoolVar(&opts.KeepPort, "keep-port", false, "Include the port in host directory names, e.g. \"localhost_3000\"")
+	flag.BoolVar(&opts.LowercaseHosts, "lowercase-hosts", false, "Lowercase host directory names")
+	flag.BoolVar(&opts.RegisteredDomain, "registered-domain", false, "Group hosts by their registered domain, e.g. \"example.com\" for \"a.example.com\"")
+	flag.BoolVar(&opts.UnicodeHosts, "unicode-hosts", false, "Decode internationalized (punycode) host names in directory names, e.g. \"münchen.de\"")
+	flag.BoolVar(&opts.SubdomainDirs, "subdomain-dirs", false, "With -registered-domain, nest each host directory within that of its registered domain")
+	flag.BoolVar(&opts.Slugify, "slugify", false, "Make output file and directory names ASCII, removing accents, transliterating Cyrillic, and replacing other characters with \"_\"")
+	flag.BoolVar(&opts.AddExtension, "add-extension", false, "Append a file extension derived from the MIME type, for paths without one")
+	flag.BoolVar(&opts.Flatten, "flatten", false, "Write all files directly to the output directory, ignoring URL directory structure")
+	flag.BoolVar(&opts.DedupeSuffix, "dedupe-suffix", false, "Suffix a content hash to colliding output paths, skipping identical content")
+	flag.StringVar(&opts.IndexName, "index-name", "index.html", "File name used for URLs with a directory style path")
+	flag.IntVar(&opts.MaxFileNameLen, "max-filename-len", 255, "Truncate file and directory names longer than this many bytes, appending a hash of the original (0 for no limit)")
+	flag.IntVar(&entryIndex, "index", -1, "Only extract the entry at this position (from 0) within the entries of each HAR file")
+	flag.BoolVar(&toStdout, "stdout", false, "With -index, write the decoded response body of the entry to stdout, rather than the output directory")
+	flag.IntVar(&opts.Limit, "limit", 0, "Stop after writing this many entries across all HAR files (0 for no limit)")
+	flag.BoolVar(&opts.SkipEmpty, "skip-empty", false, "Skip entries with no response content, rather than writing empty files")
+	flag.BoolVar(&opts.Atomic, "atomic", false, "Write each file via a temporary file, renamed into place once complete")
+	flag.IntVar(&opts.WriteRetries, "write-retries", 0, "Number of times to retry writing a file after a transient error (e.g. EAGAIN or EBUSY)")
+	flag.Var(&dirPerm, "dir-mode", "Permissions of created directories, as an octal `mode`")
+	flag.Var(&filePerm, "file-mode", "Permissions of created files, as an octal `mode`")
+	flag.Var(&bufferSize, "buffer-size", "Read HAR files through a buffer of this `size` (e.g. 1MB), rather than 4KB")
+	flag.Var(&maxSize, "max-size", "Skip response bodies larger than `size` (e.g. 500KB, 10MB)")
+	flag.Var(&minSize, "min-size", "Skip decoded response bodies smaller than `size` (e.g. 100B, 1KB)")
+	flag.BoolVar(&opts.ExtractRequests, "extract-requests", false, "Also write request post data, to a sibling file with a .request suffix")
+	flag.BoolVar(&opts.ExtractWebSockets, "extract-websockets", false, "Also write WebSocket frames, to numbered files in a sibling directory with a .ws suffix")
+	flag.BoolVar(&opts.SaveHeaders, "save-headers", false, "Also write response headers, to a sibling file with a .headers suffix")
+	flag.BoolVar(&opts.PreserveTime, "preserve-time", false, "Set the modification time of extracted files to the entry's startedDateTime")
+	flag.BoolVar(&opts.SkipDataURIs, "skip-data-uris", true, "Skip entries for data: URIs, rather than writing them to a \"_data\" directory")
+	flag.BoolVar(&opts.VerifySize, "verify-size", false, "Warn about bodies whose length differs from the recorded content size by more than 1%")
+	flag.StringVar(&opts.Creator, "creator", "", "Only process HAR files created by a tool whose name contains this text, ignoring case (e.g. \"firefox\")")
+	flag.BoolVar(&opts.Strict, "strict", false, "Reject HAR files that aren't structured as expected, and skip entries with an unsupported content encoding")
+	flag.BoolVar(&opts.SkipErrors, "skip-errors", false, "Log and skip entries that fail to process, rather than abandoning the HAR file")
+	flag.BoolVar(&opts.Dedupe, "dedupe", false, "Skip response bodies identical to one already written")
+	flag.BoolVar(&opts.DedupeSymlink, "dedupe-symlink", false, "With -dedupe, symlink duplicate bodies to the first copy instead of skipping them")
+	flag.BoolVar(&opts.Progress, "progress", false, "Periodically report progress to stderr")
+	flag.BoolVar(&recursive, "recursive", false, "Process all .har and .har.gz files within directory arguments")
+	flag.BoolVar(&opts.NoClobber, "no-clobber", false, "Skip entries whose output file already exists")
+	flag.BoolVar(&opts.DecodeContentEncoding, "decode-content-encoding", false, "Decompress response bodies according to their Content-Encoding header")
 	flag.StringVar(&hostAllowlistStr, "allowed-hosts", "", "Comma-separated list of hosts to allow (e.g. \"example.com,example.org\")")
+	flag.StringVar(&hostDenylistStr, "exclude-hosts", "", "Comma-separated list of hosts to skip (e.g. \"google-analytics.com\")")
+	flag.StringVar(&resourceTypesStr, "resource-types", "", "Comma-separated list of Chrome _resourceType values to extract (e.g. \"document,script\")")
+	flag.StringVar(&urlIncludeStr, "url-include", "", "Regular expression the request URL must match")
+	flag.Var((*queryParams)(&opts.QueryParams), "query-param", "Only extract entries whose request URL has this query parameter, given as `name[=value]` (may be repeated)")
+	flag.StringVar(&urlExcludeStr, "url-exclude", "", "Regular expression the request URL must not match")
+	flag.StringVar(&afterStr, "after", "", "Only extract entries started at or after this RFC3339 time (entries without a valid time are kept)")
+	flag.StringVar(&beforeStr, "before", "", "Only extract entries started before this RFC3339 time (entries without a valid time are kept)")
+	flag.StringVar(&methodsStr, "methods", "", "Comma-separated list of request methods to extract (e.g. \"GET,POST\")")
+	flag.StringVar(&statusesStr, "status", "", "Comma-separated list of response status codes or ranges to extract (e.g. \"200,301,400-499\")")
+	flag.BoolVar(&opts.LinkRedirects, "link-redirects", false, "Replace the files written for redirect responses with symlinks to the files written for their targets")
+	flag.StringVar(&opts.OnCollision, "on-collision", harextract.CollisionWarn, "How to handle different URLs with the same output path: \"warn\" (overwrite with a warning), \"error\", \"suffix\" (append -1, -2, etc.) or \"overwrite\"")
+	flag.StringVar(&opts.PathPrefix, "path-prefix", "", "Write all entries under this `subdir` of the output directory, which is included in manifest paths")
+	flag.StringVar(&opts.ErrorsDir, "errors-dir", "", "Write entries with an error status (400 or above) under this `subdir` of the output directory, rather than alongside other entries")
+	flag.BoolVar(&opts.SkipRedirects, "skip-redirects", false, "Skip redirect (3xx) responses, even if matched by -status")
+	flag.StringVar(&mimeTypesStr, "mime-types", "", "Comma-separated list of response MIME types to extract (e.g. \"image/*,application/javascript\")")
+	flag.StringVar(&includeExtensionsStr, "include-extensions", "", "Comma-separated list of file extensions to extract (e.g. \"js,css\")")
+	flag.StringVar(&excludeExtensionsStr, "exclude-extensions", "", "Comma-separated list of file extensions to skip (e.g. \"map\")")
+
+	command := "extract"
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "extract" || args[0] == "list" || args[0] == "stats") {
+		command, args = args[0], args[1:]
+	}
+	list := command == "list"
+	var sum *summary
+	if command == "stats" {
+		sum = newSummary()
+		opts.OnWritten = sum.add
+	}
+	_ = flag.CommandLine.Parse(args)
+
+	if printVersion {
+		fmt.Println(readBuildInfo())
+		return
+	}
 
-	flag.Parse()
+	var configErr error
+	if configPath != "" {
+		// loaded before anything else, as it may configure logging
+		configErr = loadConfig(configPath)
+	}
+
+	// stdout is reserved for data, such as the -dry-run-json output
+	log = &logger{w: os.Stderr, json: logJSON, quiet: quiet}
+	opts.Logger = log
+
+	if configErr != nil {
+		log.log(levelError, "Invalid -config value", field("error", configErr))
+		os.Exit(1)
+	}
+
+	if log.json {
+		// identifies the build in collected logs
+		info := readBuildInfo()
+		log.event(levelInfo, "Starting", "Starting "+info.String(),
+			field("version", info.Version), field("goVersion", info.GoVersion), field("commit", info.Commit))
+	}
+	opts.MaxSize = int64(maxSize)
+	opts.MinSize = int64(minSize)
+	opts.BufferSize = int(bufferSize)
+	opts.DirMode = os.FileMode(dirPerm)
+	opts.FileMode = os.FileMode(filePerm)
 
 	if flag.NArg() == 0 {
-		fmt.Println("Please provide at least one HAR file to process")
+		log.log(levelError, "Please provide at least one HAR file to process")
 		os.Exit(1)
 	}
 
-	hostAllowlist := make(map[string]bool)
-	if hostAllowlistStr != "" {
-		for _, host := range strings.Split(hostAllowlistStr, ",") {
-			hostAllowlist[host] = true
+	opts.HostAllowlist = parseList(hostAllowlistStr)
+	opts.HostDenylist = parseList(hostDenylistStr)
+	opts.MimeTypes = parseList(strings.ToLower(mimeTypesStr))
+	opts.Methods = parseList(strings.ToUpper(methodsStr))
+	opts.ResourceTypes = parseList(strings.ToLower(resourceTypesStr))
+	opts.IncludeExtensions = parseExtensions(includeExtensionsStr)
+	opts.ExcludeExtensions = parseExtensions(excludeExtensionsStr)
+
+	if opts.IndexName == "" || strings.ContainsAny(opts.IndexName, "/\\") {
+		log.log(levelError, "Invalid -index-name value", field("error", "must be a file name"))
+		os.Exit(1)
+	}
+
+	if opts.StatusDir != "" && opts.StatusDir != harextract.StatusDirClass && opts.StatusDir != harextract.StatusDirExact {
+		log.log(levelError, "Invalid -dir-per-status value", field("error", `must be "class" or "exact"`))
+		os.Exit(1)
+	}
+
+	switch opts.OnCollision {
+	case harextract.CollisionWarn, harextract.CollisionError, harextract.CollisionSuffix, harextract.CollisionOverwrite:
+	default:
+		log.log(levelError, "Invalid -on-collision value", field("error", `must be "warn", "error", "suffix" or "overwrite"`))
+		os.Exit(1)
+	}
+
+	if noWrite && manifestPath == "" {
+		log.log(levelError, "Invalid -no-write value", field("error", "requires -manifest"))
+		os.Exit(1)
+	}
+	if noWrite && opts.DirsOnly {
+		log.log(levelError, "Invalid -no-write value", field("error", "cannot be combined with -dirs-only"))
+		os.Exit(1)
+	}
+
+	if opts.SkipUnprefixed && opts.StripPathPrefix == "" {
+		log.log(levelError, "Invalid -skip-unprefixed value", field("error", "requires -strip-path-prefix"))
+		os.Exit(1)
+	}
+
+	if opts.SubdomainDirs && !opts.RegisteredDomain {
+		log.log(levelError, "Invalid -subdomain-dirs value", field("error", "requires -registered-domain"))
+		os.Exit(1)
+	}
+
+	if toStdout && entryIndex < 0 {
+		log.log(levelError, "Invalid -stdout value", field("error", "requires -index"))
+		os.Exit(1)
+	}
+	archiveToStdout := zipPath == "-" || tarPath == "-" || tarGzPath == "-"
+	if toStdout && (flag.NArg() > 1 || dryRunJSON || archiveToStdout || command != "extract") {
+		log.log(levelError, "Invalid -stdout value", field("error", "requires a single HAR file, and can't be combined with other output to stdout"))
+		os.Exit(1)
+	}
+
+	if ndjson && (toStdout || dryRunJSON || archiveToStdout || command != "extract") {
+		log.log(levelError, "Invalid -ndjson value", field("error", "can't be combined with other output to stdout"))
+		os.Exit(1)
+	}
+
+	if opts.ErrorsDir != "" && !filepath.IsLocal(opts.ErrorsDir) {
+		log.log(levelError, "Invalid -errors-dir value", field("error", "must be a relative path within the output directory"))
+		os.Exit(1)
+	}
+
+	if opts.PathPrefix != "" && !filepath.IsLocal(opts.PathPrefix) {
+		log.log(levelError, "Invalid -path-prefix value", field("error", "must be a relative path within the output directory"))
+		os.Exit(1)
+	}
+
+	if opts.WriteRetries < 0 {
+		log.log(levelError, "Invalid -write-retries value", field("error", "must not be negative"))
+		os.Exit(1)
+	}
+
+	if opts.MaxFileNameLen < 0 || (opts.MaxFileNameLen > 0 && opts.MaxFileNameLen < 16) {
+		log.log(levelError, "Invalid -max-filename-len value", field("error", "must be 0 or at least 16"))
+		os.Exit(1)
+	}
+
+	if fileConcurrency < 1 {
+		log.log(levelError, "Invalid -file-concurrency value", field("error", "must be at least 1"))
+		os.Exit(1)
+	}
+	if fileConcurrency > 1 && entryIndex >= 0 {
+		log.log(levelError, "Invalid -file-concurrency value", field("error", "cannot be combined with -index"))
+		os.Exit(1)
+	}
+	if fileConcurrency > 1 && list {
+		log.log(levelError, "Invalid -file-concurrency value", field("error", "cannot be combined with the list subcommand"))
+		os.Exit(1)
+	}
+
+	if bufferSize > 1<<30 {
+		log.log(levelError, "Invalid -buffer-size value", field("error", "must be at most 1GB"))
+		os.Exit(1)
+	}
+
+	var err error
+	if opts.NameTemplate, err = harextract.ParseNameTemplate(nameTemplateStr); err != nil {
+		log.log(levelError, "Invalid -name-template value", field("error", err))
+		os.Exit(1)
+	}
+	if opts.Flatten && nameTemplateStr != harextract.DefaultNameTemplate {
+		log.log(levelError, "Invalid -name-template value", field("error", "cannot be combined with -flatten"))
+		os.Exit(1)
+	}
+
+	if opts.Statuses, err = parseStatusRanges(statusesStr); err != nil {
+		log.log(levelError, "Invalid -status value", field("error", err))
+		os.Exit(1)
+	}
+
+	if urlIncludeStr != "" {
+		if opts.URLInclude, err = regexp.Compile(urlIncludeStr); err != nil {
+			log.log(levelError, "Invalid -url-include value", field("error", err))
+			os.Exit(1)
 		}
 	}
 
-	for _, harFilePath := range flag.Args() {
-		file, err := os.Open(harFilePath)
-		if err != nil {
-			fmt.Println("Failed to open HAR file:", err)
+	if urlExcludeStr != "" {
+		if opts.URLExclude, err = regexp.Compile(urlExcludeStr); err != nil {
+			log.log(levelError, "Invalid -url-exclude value", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if afterStr != "" {
+		if opts.After, err = time.Parse(time.RFC3339, afterStr); err != nil {
+			log.log(levelError, "Invalid -after value", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if beforeStr != "" {
+		if opts.Before, err = time.Parse(time.RFC3339, beforeStr); err != nil {
+			log.log(levelError, "Invalid -before value", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if dryRunJSON || list || sum != nil || opts.DirsOnly || noWrite {
+		opts.DryRun = true
+	}
+
+	// paths are within the archive, for which the output directory is unused
+	outputDir := opts.RootDir
+	var closeArchive func() error
+	var archiveFlag, archivePath string
+	for _, a := range []struct{ flag, path string }{{"zip", zipPath}, {"tar", tarPath}, {"tar.gz", tarGzPath}} {
+		if a.path == "" {
 			continue
 		}
+		if archiveFlag != "" {
+			log.log(levelError, "Invalid -"+a.flag+" value", field("error", "cannot be combined with -"+archiveFlag))
+			os.Exit(1)
+		}
+		if genIndex {
+			log.log(levelError, "Invalid -gen-index value", field("error", "cannot be combined with -"+a.flag))
+			os.Exit(1)
+		}
+		if opts.DirsOnly {
+			log.log(levelError, "Invalid -dirs-only value", field("error", "cannot be combined with -"+a.flag))
+			os.Exit(1)
+		}
+		archiveFlag, archivePath = a.flag, a.path
+	}
+	// only once the flags are known to be valid, as an existing file is
+	// truncated
+	if archiveFlag != "" {
+		outputDir = ""
+		if opts.Archive, closeArchive, err = createArchive(archiveFlag, archivePath, opts.FileMode, opts.DryRun); err != nil {
+			log.log(levelError, "Failed to create archive", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// the manifest and index list files actually written, so they are skipped
+	// in dry run mode, unless the manifest is all that -no-write writes
+	opts.Manifest = ((manifestPath != "" || genIndex) && !opts.DryRun) || dryRunJSON || noWrite
+
+	if ndjson {
+		enc := json.NewEncoder(os.Stdout)
+		opts.OnWritten = func(written harextract.ManifestEntry) {
+			_ = enc.Encode(writtenEntry{
+				URL:    written.URL,
+				Path:   filepath.Join(outputDir, filepath.FromSlash(written.OutputPath)),
+				Status: written.Status,
+				Bytes:  written.Bytes,
+			})
+		}
+	}
+	if list {
+		opts.OnWritten = func(written harextract.ManifestEntry) {
+			printEntry(os.Stdout, written)
+		}
+	}
+
+	// with -index, every other entry is skipped, and the rest of the HAR is
+	// left unread once the entry has been seen
+	var seen int
+	var selected *harextract.Entry
+	if entryIndex >= 0 {
+		opts.OnEntry = func(entry *harextract.Entry) (bool, error) {
+			i := seen
+			seen++
+			switch {
+			case i < entryIndex:
+				return true, nil
+			case i == entryIndex && toStdout:
+				e := *entry
+				selected = &e
+				return true, errIndexDone
+			case i == entryIndex:
+				return false, nil
+			default:
+				return true, errIndexDone
+			}
+		}
+	}
+
+	x := harextract.New(opts)
+	var total harextract.Stats
+	var stdinRead bool
+	var files, failed int
+
+	// shells such as that of Windows don't expand wildcards
+	var harArgs []string
+	for _, arg := range flag.Args() {
+		if _, err := os.Stat(arg); err == nil || arg == "-" || isHarURL(arg) || !strings.ContainsAny(arg, "*?[") {
+			harArgs = append(harArgs, arg)
+		} else if matches, err := filepath.Glob(arg); err != nil {
+			log.log(levelError, "Failed to open HAR file", field("path", arg), field("error", err))
+			files++
+			failed++
+		} else if len(matches) == 0 {
+			log.log(levelError, "Failed to open HAR file", field("path", arg), field("error", "no files matched"))
+			files++
+			failed++
+		} else {
+			harArgs = append(harArgs, matches...)
+		}
+	}
+
+	var harFilePaths []string
+	// zipMembers are the HAR files within zip archive arguments, by their
+	// path, e.g. "capture.zip/inner.har"
+	zipMembers := make(map[string]*zip.File)
+	for _, arg := range harArgs {
+		if info, err := os.Stat(arg); err == nil && !info.IsDir() && strings.HasSuffix(strings.ToLower(arg), ".zip") {
+			members, err := openZipHars(arg)
+			if err != nil {
+				log.log(levelError, "Failed to open zip archive", field("path", arg), field("error", err))
+				files++
+				failed++
+				continue
+			}
+			for _, member := range members {
+				name := arg + "/" + member.Name
+				zipMembers[name] = member
+				harFilePaths = append(harFilePaths, name)
+			}
+		} else if arg == "-" || isHarURL(arg) || err != nil || !info.IsDir() {
+			harFilePaths = append(harFilePaths, arg)
+		} else if !recursive {
+			log.log(levelError, "Failed to open HAR file", field("path", arg), field("error", "is a directory (see -recursive)"))
+			files++
+			failed++
+		} else if found, err := findHarFiles(arg); err != nil {
+			log.log(levelError, "Failed to search directory", field("error", err))
+			files++
+			failed++
+		} else {
+			harFilePaths = append(harFilePaths, found...)
+		}
+	}
+	files += len(harFilePaths)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		// a second interrupt terminates immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	client := &http.Client{Timeout: timeout}
+
+	// mu serializes the reporting of each file's results, and the totals
+	var mu sync.Mutex
+	extractFile := func(harFilePath string) {
+		if list {
+			// files are extracted one at a time, so each file's rows follow
+			// its header
+			if len(harFilePaths) > 1 {
+				fmt.Printf("%s:\n", harFilePath)
+			}
+			printEntriesHeader(os.Stdout)
+		}
+		var res harextract.Stats
+		var file *os.File
+		var err error
+		if isHarURL(harFilePath) {
+			res, err = fetchHar(ctx, client, harFilePath, x)
+		} else if member, ok := zipMembers[harFilePath]; ok {
+			res, err = extractZipMember(ctx, member, x)
+		} else if harFilePath == "-" {
+			mu.Lock()
+			if stdinRead {
+				log.log(levelError, "Failed to open HAR file", field("error", "stdin may only be read once"))
+				failed++
+				mu.Unlock()
+				return
+			}
+			stdinRead = true
+			mu.Unlock()
+			harFilePath = "<stdin>"
+			file = os.Stdin
+		} else if file, err = os.Open(harFilePath); err != nil {
+			log.event(levelError, "Failed to open HAR file", "Failed to open HAR file: "+err.Error(), field("path", harFilePath), field("error", err))
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			return
+		}
+
+		if entryIndex >= 0 {
+			// files are extracted one at a time, with -index
+			seen, selected = 0, nil
+		}
+		if file != nil {
+			res, err = x.Extract(ctx, file)
+			_ = file.Close()
+		}
+		err = withoutIndexDone(err)
+		if err == nil && entryIndex >= 0 && seen <= entryIndex {
+			err = fmt.Errorf("entry index %d is out of range, with %d entries", entryIndex, seen)
+		}
+		if err == nil && selected != nil {
+			var data []byte
+			if data, err = harextract.ResponseBody(*selected, &opts); err == nil {
+				_, err = os.Stdout.Write(data)
+			}
+		}
 
-		var count int
-		count, err = processHar(bufio.NewReader(file), output, removeQueryString, dryRun, verbose, hostAllowlist)
-		_ = file.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		if errors.Is(err, harextract.ErrCreatorMismatch) {
+			log.event(levelInfo, "Skipping HAR file",
+				fmt.Sprintf("Skipping HAR file (%s): %s", err, harFilePath),
+				field("path", harFilePath), field("error", err))
+			return
+		}
+		total.Add(res)
+		if err != nil && ctx.Err() != nil {
+			log.event(levelError, "Interrupted",
+				fmt.Sprintf("Interrupted (%s): %s", res, harFilePath),
+				append([]harextract.Field{field("path", harFilePath)}, statsFields(res)...)...)
+			return
+		}
 		if err != nil {
-			fmt.Printf("Failed to process HAR file (%d entries processed): %s\n", count, err)
-			continue
+			log.event(levelError, "Failed to process HAR file",
+				fmt.Sprintf("Failed to process HAR file (%s): %s: %s", res, harFilePath, err),
+				append([]harextract.Field{field("path", harFilePath), field("error", err)}, statsFields(res)...)...)
+			failed++
+			return
 		}
 
-		fmt.Printf("Successfully processed HAR file (%d entries processed): %s\n", count, harFilePath)
+		log.event(levelInfo, "Successfully processed HAR file",
+			fmt.Sprintf("Successfully processed HAR file (%s): %s", res, harFilePath),
+			append([]harextract.Field{field("path", harFilePath)}, statsFields(res)...)...)
+	}
+
+	// up to fileConcurrency files are extracted at once, and no more are
+	// started once interrupted
+	sem := make(chan struct{}, fileConcurrency)
+	var wg sync.WaitGroup
+	for _, harFilePath := range harFilePaths {
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(harFilePath string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			extractFile(harFilePath)
+		}(harFilePath)
+	}
+	wg.Wait()
+
+	// redirects may target an entry of any of the files, so they are linked
+	// once all have been extracted
+	x.LinkRedirects()
+
+	if closeArchive != nil {
+		// completes the archive, including any files written before a failure
+		if err := closeArchive(); err != nil {
+			log.log(levelError, "Failed to write archive", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if dryRunJSON {
+		if err := printPlannedWrites(os.Stdout, outputDir, total.Manifest); err != nil {
+			log.log(levelError, "Failed to print planned writes", field("error", err))
+			os.Exit(1)
+		}
+	} else if opts.Manifest && manifestPath != "" && (!opts.DryRun || noWrite) {
+		if err := writeManifest(manifestPath, total.Manifest, opts.FileMode); err != nil {
+			log.log(levelError, "Failed to write manifest", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if genIndex && !opts.DryRun {
+		if err := writeIndex(opts.RootDir, total.Manifest, opts.FileMode); err != nil {
+			log.log(levelError, "Failed to write index", field("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if sum != nil {
+		sum.print(os.Stdout, total)
+	}
+
+	log.event(levelInfo, "Total", fmt.Sprintf("Total (%s)", total), append(statsFields(total), field("hosts", total.Hosts), field("skipReasons", total.SkipReasons))...)
+	if opts.Verbose && !log.json && len(total.Hosts) > 0 {
+		var hosts strings.Builder
+		printCounts(&hosts, total.Hosts)
+		log.event(levelInfo, "Entries written per host", "Entries written per host:\n"+strings.TrimSuffix(hosts.String(), "\n"))
+	}
+	if opts.Verbose && !log.json && len(total.SkipReasons) > 0 {
+		var reasons strings.Builder
+		printCounts(&reasons, reasonCounts(total.SkipReasons))
+		log.event(levelInfo, "Entries skipped per reason", "Entries skipped per reason:\n"+strings.TrimSuffix(reasons.String(), "\n"))
+	}
+
+	if opts.Dedupe {
+		log.event(levelInfo, "Deduplication saved bytes", fmt.Sprintf("Deduplication saved %d bytes", x.SavedBytes()), field("bytes", x.SavedBytes()))
+	}
+
+	if failed > 0 {
+		log.event(levelError, "Files failed", fmt.Sprintf("%d of %d files failed", failed, files), field("failed", failed), field("files", files))
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		// the conventional status for termination by SIGINT
+		os.Exit(130)
+	case failed > 0 || total.Failed > 0:
+		// including entries skipped with -skip-errors
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main in place of the tests, when re-executed by runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("HAR_EXTRACTOR_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args in dir, returning its combined output
+// and exit status.
+func runMain(t *testing.T, dir string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "HAR_EXTRACTOR_RUN_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// writeHar writes a HAR with an entry for each of the response texts,
+// base64 encoded, to a file in dir, returning its path.
+func writeHar(t *testing.T, dir string, texts ...string) string {
+	t.Helper()
+	har := `{"log":{"entries":[`
+	for i, text := range texts {
+		if i > 0 {
+			har += ","
+		}
+		har += `{"request":{"method":"GET","url":"https://example.com/` + string(rune('a'+i)) + `.bin"},` +
+			`"response":{"status":200,"content":{"mimeType":"application/octet-stream","encoding":"base64","text":"` + text + `"}}}`
+	}
+	har += `]}}`
+	path := filepath.Join(dir, "test.har")
+	if err := os.WriteFile(path, []byte(har), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExitStatusSkipErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name  string
+		texts []string
+		want  int
+	}{
+		{name: "valid", texts: []string{"aGk=", "aGk="}, want: 0},
+		{name: "invalid", texts: []string{"aGk=", "!!!!"}, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			har := writeHar(t, dir, tc.texts...)
+			out, status := runMain(t, dir, "-o", t.TempDir(), "-skip-errors", har)
+			if status != tc.want {
+				t.Errorf("got exit status %d, want %d, with output:\n%s", status, tc.want, out)
+			}
+		})
+	}
+}
+
+func TestFileModeManifestAndIndex(t *testing.T) {
+	dir := t.TempDir()
+	har := writeHar(t, dir, "aGk=")
+	out := filepath.Join(dir, "out")
+	manifest := filepath.Join(dir, "manifest.json")
+	if output, status := runMain(t, dir, "-o", out, "-file-mode", "0600", "-manifest", manifest, "-gen-index", har); status != 0 {
+		t.Fatalf("got exit status %d, with output:\n%s", status, output)
+	}
+	for _, path := range []string{manifest, filepath.Join(out, "index.html")} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("%s: got mode %v, want %v", path, perm, os.FileMode(0o600))
+		}
+	}
+}
+
+func TestArchiveConflictKeepsFiles(t *testing.T) {
+	dir := t.TempDir()
+	har := writeHar(t, dir, "aGk=")
+	keep := filepath.Join(dir, "keep.zip")
+	if err := os.WriteFile(keep, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if output, status := runMain(t, dir, "-zip", keep, "-tar", filepath.Join(dir, "k.tar"), har); status == 0 {
+		t.Fatalf("got exit status 0, with output:\n%s", output)
+	}
+	if data, err := os.ReadFile(keep); err != nil || string(data) != "existing" {
+		t.Errorf("got %q, %v, want the existing file left alone", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "k.tar")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the conflicting archive not created", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	har := writeHar(t, dir, "aGk=", "aGk=")
+	output, status := runMain(t, dir, "list", har)
+	if status != 0 {
+		t.Fatalf("got exit status %d, with output:\n%s", status, output)
+	}
+	header := strings.Index(output, "INDEX")
+	for _, url := range []string{"https://example.com/a.bin", "https://example.com/b.bin"} {
+		if i := strings.Index(output, url); i < 0 || i < header {
+			t.Errorf("got no row for %s after the header, in output:\n%s", url, output)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want nothing written", err)
+	}
+
+	// the rows of each file are printed under its own header
+	if output, status := runMain(t, dir, "list", "-file-concurrency", "2", har, har); status == 0 {
+		t.Errorf("got exit status 0, with output:\n%s", output)
+	}
+}
+
+func TestIndexFailure(t *testing.T) {
+	dir := t.TempDir()
+	// the entry after that selected stops the HAR being read, which mustn't
+	// hide the selected entry failing
+	har := writeHar(t, dir, "aGk=", "!!!!", "aGk=")
+	output, status := runMain(t, dir, "-o", filepath.Join(dir, "out"), "-index", "1", har)
+	if status == 0 {
+		t.Errorf("got exit status 0, with output:\n%s", output)
+	}
+	if strings.Contains(output, "Successfully processed") {
+		t.Errorf("got success reported, in output:\n%s", output)
+	}
+}
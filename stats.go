@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/joeycumines/har-extractor/harextract"
+)
+
+// largestEntries is the number of entries listed by the stats subcommand.
+const largestEntries = 10
+
+// summary aggregates the entries of one or more HARs, for the stats
+// subcommand.
+type summary struct {
+	statuses  map[string]int
+	mimeTypes map[string]int
+	hosts     map[string]int
+	bytes     int64
+	largest   []harextract.ManifestEntry
+}
+
+func newSummary() *summary {
+	return &summary{
+		statuses:  make(map[string]int),
+		mimeTypes: make(map[string]int),
+		hosts:     make(map[string]int),
+	}
+}
+
+// add records entry, as a harextract.Options.OnWritten hook.
+func (s *summary) add(entry harextract.ManifestEntry) {
+	s.statuses[fmt.Sprintf("%dxx", entry.Status/100)]++
+	mimeType, _, _ := strings.Cut(entry.MimeType, ";")
+	if mimeType = strings.ToLower(strings.TrimSpace(mimeType)); mimeType == "" {
+		mimeType = "(none)"
+	}
+	s.mimeTypes[mimeType]++
+	s.hosts[entry.Host]++
+	s.bytes += int64(entry.Bytes)
+
+	// only the URLs of the largest entries are retained
+	i := sort.Search(len(s.largest), func(i int) bool { return s.largest[i].Bytes < entry.Bytes })
+	if i < largestEntries {
+		s.largest = append(s.largest, harextract.ManifestEntry{})
+		copy(s.largest[i+1:], s.largest[i:])
+		s.largest[i] = entry
+		if len(s.largest) > largestEntries {
+			s.largest = s.largest[:largestEntries]
+		}
+	}
+}
+
+// print writes the summary, where total counts every entry, including those
+// that were skipped.
+func (s *summary) print(w io.Writer, total harextract.Stats) {
+	fmt.Fprintf(w, "Entries: %d (%d matched, %d skipped, %d failed)\n", total.Entries, total.Written, total.Skipped, total.Failed)
+	fmt.Fprintf(w, "Body bytes: %d (%s)\n", s.bytes, harextract.FormatBytes(s.bytes))
+	for _, table := range []struct {
+		title  string
+		counts map[string]int
+	}{
+		{"Status classes", s.statuses},
+		{"MIME types", s.mimeTypes},
+		{"Hosts", s.hosts},
+		{"Skip reasons", reasonCounts(total.SkipReasons)},
+	} {
+		if len(table.counts) > 0 {
+			fmt.Fprintf(w, "%s:\n", table.title)
+			printCounts(w, table.counts)
+		}
+	}
+	if len(s.largest) > 0 {
+		fmt.Fprintln(w, "Largest entries:")
+		for _, entry := range s.largest {
+			fmt.Fprintf(w, "%8s  %s\n", harextract.FormatBytes(int64(entry.Bytes)), entry.URL)
+		}
+	}
+}
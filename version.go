@@ -0,0 +1,56 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit may be set at build time, e.g. with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234".
+var (
+	version string
+	commit  string
+)
+
+// buildInfo describes the running build.
+type buildInfo struct {
+	Version   string
+	GoVersion string
+	Commit    string
+}
+
+// readBuildInfo returns the version and commit set at build time, falling
+// back to the module version and VCS revision embedded by the go command.
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: version, GoVersion: runtime.Version(), Commit: commit}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		var modified bool
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	return "har-extractor " + b.Version + " (" + b.GoVersion + ", commit " + b.Commit + ")"
+}